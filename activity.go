@@ -0,0 +1,111 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	activityModeAny = "any"
+	activityModeAll = "all"
+)
+
+// ActivitySource reports when namespaces were last active.
+// Namespaces without any activity known to the source are absent from the returned map.
+type ActivitySource interface {
+	Name() string
+	LastActivity(ctx context.Context, namespaces []string) (map[string]time.Time, error)
+}
+
+// multiActivitySource combines several activity sources.
+// With mode any a namespace is active if any source reports activity, so it is only idle if all sources agree.
+// With mode all a namespace is only active if every source reports activity.
+type multiActivitySource struct {
+	sources []ActivitySource
+	mode    string
+	logger  *slog.Logger
+}
+
+func (m *multiActivitySource) Name() string {
+	var names []string
+	for _, source := range m.sources {
+		names = append(names, source.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+func (m *multiActivitySource) LastActivity(ctx context.Context, namespaces []string) (map[string]time.Time, error) {
+	results := make([]map[string]time.Time, 0, len(m.sources))
+	for _, source := range m.sources {
+		activity, err := source.LastActivity(ctx, namespaces)
+		if err != nil {
+			m.logger.Error("Error getting activity", "source", source.Name(), "err", err)
+			return nil, fmt.Errorf("activity source %s: %w", source.Name(), err)
+		}
+		m.logger.Debug("Activity returned", "source", source.Name(), "count", len(activity))
+		results = append(results, activity)
+	}
+	return mergeActivity(results, m.mode), nil
+}
+
+// mergeActivity merges activity results. Mode any keeps the newest activity from any result,
+// mode all keeps the oldest activity. A namespace missing from a result has no opinion from that source
+// rather than being idle, otherwise one source without data for a namespace would make it idle in mode all.
+func mergeActivity(results []map[string]time.Time, mode string) map[string]time.Time {
+	merged := make(map[string]time.Time)
+	if mode == activityModeAll {
+		for _, result := range results {
+			for namespace, t := range result {
+				if current, ok := merged[namespace]; !ok || t.Before(current) {
+					merged[namespace] = t
+				}
+			}
+		}
+		return merged
+	}
+	for _, result := range results {
+		for namespace, t := range result {
+			if current, ok := merged[namespace]; !ok || t.After(current) {
+				merged[namespace] = t
+			}
+		}
+	}
+	return merged
+}
+
+// getActivitySource returns the activity source configured by flags
+func getActivitySource(clientset kubernetes.Interface, logger *slog.Logger) (ActivitySource, error) {
+	var sources []ActivitySource
+	for _, name := range strings.Split(*activitySources, ",") {
+		switch strings.TrimSpace(name) {
+		case "prometheus":
+			sources = append(sources, &prometheusSource{logger: logger})
+		case "kubernetes":
+			sources = append(sources, &kubernetesSource{clientset: clientset, logger: logger})
+		default:
+			return nil, fmt.Errorf("unknown activity source %q", name)
+		}
+	}
+	if len(sources) == 1 {
+		return sources[0], nil
+	}
+	return &multiActivitySource{sources: sources, mode: *activityMode, logger: logger}, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+)
+
+type staticSource struct {
+	name     string
+	activity map[string]time.Time
+	err      error
+}
+
+func (s *staticSource) Name() string {
+	return s.name
+}
+
+func (s *staticSource) LastActivity(ctx context.Context, namespaces []string) (map[string]time.Time, error) {
+	return s.activity, s.err
+}
+
+func TestMultiActivitySource(t *testing.T) {
+	older := creationTime
+	newer := creationTime.Add(time.Hour)
+	first := &staticSource{name: "first", activity: map[string]time.Time{"user-user1": older, "user-user2": newer}}
+	second := &staticSource{name: "second", activity: map[string]time.Time{"user-user1": newer, "user-user3": older}}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	tests := []struct {
+		mode     string
+		expected map[string]time.Time
+	}{
+		{
+			mode:     activityModeAny,
+			expected: map[string]time.Time{"user-user1": newer, "user-user2": newer, "user-user3": older},
+		},
+		{
+			// Namespaces missing from one source use the activity from the other
+			mode:     activityModeAll,
+			expected: map[string]time.Time{"user-user1": older, "user-user2": newer, "user-user3": older},
+		},
+	}
+	for _, test := range tests {
+		source := &multiActivitySource{sources: []ActivitySource{first, second}, mode: test.mode, logger: logger}
+		if source.Name() != "first,second" {
+			t.Errorf("Unexpected name: %s", source.Name())
+		}
+		activity, err := source.LastActivity(context.Background(), nil)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(activity, test.expected) {
+			t.Errorf("Unexpected activity for mode %s\nExpected: %v\nGot: %v", test.mode, test.expected, activity)
+		}
+	}
+
+	failing := &staticSource{name: "failing", err: errors.New("failed")}
+	source := &multiActivitySource{sources: []ActivitySource{first, failing}, mode: activityModeAny, logger: logger}
+	if _, err := source.LastActivity(context.Background(), nil); err == nil {
+		t.Errorf("Expected error from failing source")
+	}
+}
+
+func TestGetActivitySource(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	if _, err := kingpin.CommandLine.Parse([]string{"--prometheus-address=foobar"}); err != nil {
+		t.Fatal(err)
+	}
+	source, err := getActivitySource(clientset(), logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if source.Name() != "prometheus" {
+		t.Errorf("Unexpected source: %s", source.Name())
+	}
+	if _, err := kingpin.CommandLine.Parse([]string{"--prometheus-address=foobar", "--activity-source=foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getActivitySource(clientset(), logger); err == nil {
+		t.Errorf("Expected error for unknown source")
+	}
+}
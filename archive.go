@@ -0,0 +1,201 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/yaml"
+)
+
+const archiveTimeFormat = "20060102T150405Z"
+
+// archivedMetadataFields are set by the API server and removed from archived resources
+var archivedMetadataFields = []string{
+	"managedFields",
+	"resourceVersion",
+	"uid",
+	"creationTimestamp",
+	"generation",
+	"selfLink",
+	"deletionTimestamp",
+	"deletionGracePeriodSeconds",
+}
+
+// archiveNamespace exports every namespaced resource in a namespace as YAML into a gzipped tarball in the archive directory.
+// The tarball is written to a temporary file and only renamed into place once complete.
+func archiveNamespace(ctx context.Context, discoveryClient discovery.DiscoveryInterface, dynamicClient dynamic.Interface, namespace string, logger *slog.Logger) (string, error) {
+	resources, err := discovery.ServerPreferredNamespacedResources(discoveryClient)
+	if failed, ok := err.(*discovery.ErrGroupDiscoveryFailed); ok {
+		// An unavailable aggregated API such as metrics-server would otherwise block archiving every namespace,
+		// the groups that were discovered are archived
+		for gv, gvErr := range failed.Groups {
+			logger.Warn("Unable to discover API group, its resources are not archived", "namespace", namespace, "group", gv.String(), "err", gvErr)
+			metricArchiveDiscoveryFailuresTotal.WithLabelValues(gv.String()).Inc()
+		}
+	} else if err != nil {
+		return "", fmt.Errorf("error discovering namespaced resources: %w", err)
+	}
+	if err := os.MkdirAll(*archiveDir, 0700); err != nil {
+		return "", err
+	}
+	name := filepath.Join(*archiveDir, fmt.Sprintf("%s-%s.tar.gz", namespace, timeNow().UTC().Format(archiveTimeFormat)))
+	tmp, err := os.CreateTemp(*archiveDir, ".tmp-"+namespace+"-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	gz := gzip.NewWriter(tmp)
+	tw := tar.NewWriter(gz)
+
+	ns, err := dynamicClient.Resource(schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}).Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("error getting namespace: %w", err)
+	}
+	if err := archiveObject(tw, "namespace.yaml", ns); err != nil {
+		return "", err
+	}
+	count := 0
+	for _, list := range resources {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			return "", err
+		}
+		for _, resource := range list.APIResources {
+			if !slices.Contains(resource.Verbs, "list") || archiveSkipped(resource.Kind, gv.Group) {
+				continue
+			}
+			gvr := gv.WithResource(resource.Name)
+			objects, err := dynamicClient.Resource(gvr).Namespace(namespace).List(ctx, metav1.ListOptions{})
+			if err != nil {
+				return "", fmt.Errorf("error listing %s: %w", gvr.GroupResource().String(), err)
+			}
+			for i := range objects.Items {
+				obj := &objects.Items[i]
+				path := filepath.Join(gvr.GroupResource().String(), obj.GetName()+".yaml")
+				if err := archiveObject(tw, path, obj); err != nil {
+					return "", err
+				}
+				count++
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return "", err
+	}
+	logger.Info("Archived namespace", "namespace", namespace, "archive", name, "resources", count)
+	return name, nil
+}
+
+// archiveObject strips server managed fields from an object and writes it to the tarball as YAML
+func archiveObject(tw *tar.Writer, path string, obj *unstructured.Unstructured) error {
+	obj = obj.DeepCopy()
+	for _, field := range archivedMetadataFields {
+		unstructured.RemoveNestedField(obj.Object, "metadata", field)
+	}
+	unstructured.RemoveNestedField(obj.Object, "status")
+	data, err := yaml.Marshal(obj.Object)
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{
+		Name:    path,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: timeNow(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// archiveSkipped returns true if a kind is configured to be skipped, either by kind or kind.group
+func archiveSkipped(kind string, group string) bool {
+	for _, skip := range strings.Split(*archiveSkipKinds, ",") {
+		skip = strings.TrimSpace(skip)
+		if strings.EqualFold(skip, kind) || (group != "" && strings.EqualFold(skip, kind+"."+group)) {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneArchives removes archives older than the archive retention
+func pruneArchives(logger *slog.Logger) int {
+	if *archiveDir == "" || *archiveRetention <= 0 {
+		return 0
+	}
+	archives, err := filepath.Glob(filepath.Join(*archiveDir, "*.tar.gz"))
+	if err != nil {
+		logger.Error("Error listing archives", "err", err)
+		return 1
+	}
+	sort.Strings(archives)
+	errCount := 0
+	cutoff := timeNow().Add(-*archiveRetention)
+	for _, archive := range archives {
+		created, ok := archiveTime(archive)
+		if !ok || !created.Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(archive); err != nil {
+			errCount++
+			logger.Error("Error removing archive", "archive", archive, "err", err)
+			continue
+		}
+		logger.Info("Removed archive older than retention", "archive", archive)
+	}
+	return errCount
+}
+
+// archiveTime parses the time an archive was created from its file name
+func archiveTime(archive string) (time.Time, bool) {
+	base := strings.TrimSuffix(filepath.Base(archive), ".tar.gz")
+	i := strings.LastIndex(base, "-")
+	if i < 0 {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(archiveTimeFormat, base[i+1:])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
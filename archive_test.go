@@ -0,0 +1,356 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func archiveResources(clientset kubernetes.Interface) {
+	clientset.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "namespaces", Kind: "Namespace", Verbs: []string{"get", "list", "delete"}},
+				{Name: "configmaps", Kind: "ConfigMap", Namespaced: true, Verbs: []string{"get", "list"}},
+				{Name: "secrets", Kind: "Secret", Namespaced: true, Verbs: []string{"get", "list"}},
+				{Name: "serviceaccounts", Kind: "ServiceAccount", Namespaced: true, Verbs: []string{"get", "list"}},
+				{Name: "events", Kind: "Event", Namespaced: true, Verbs: []string{"get", "list"}},
+				{Name: "pods", Kind: "Pod", Namespaced: true, Verbs: []string{"get", "list"}},
+				{Name: "services", Kind: "Service", Namespaced: true, Verbs: []string{"get", "list"}},
+				{Name: "persistentvolumeclaims", Kind: "PersistentVolumeClaim", Namespaced: true, Verbs: []string{"get", "list"}},
+				{Name: "pods/log", Kind: "Pod", Namespaced: true, Verbs: []string{"get"}},
+				{Name: "bindings", Kind: "Binding", Namespaced: true, Verbs: []string{"create"}},
+			},
+		},
+		{
+			GroupVersion: "rbac.authorization.k8s.io/v1",
+			APIResources: []metav1.APIResource{
+				{Name: "roles", Kind: "Role", Namespaced: true, Verbs: []string{"get", "list"}},
+			},
+		},
+		{
+			GroupVersion: "apps/v1",
+			APIResources: []metav1.APIResource{
+				{Name: "deployments", Kind: "Deployment", Namespaced: true, Verbs: []string{"get", "list"}},
+			},
+		},
+	}
+}
+
+func archiveObjects(namespace string) []runtime.Object {
+	metadata := func(name string) map[string]any {
+		return map[string]any{
+			"name":              name,
+			"namespace":         namespace,
+			"uid":               "d9f1e4a0-0000-0000-0000-000000000000",
+			"resourceVersion":   "12345",
+			"creationTimestamp": "2020-01-01T13:00:00Z",
+			"managedFields":     []any{map[string]any{"manager": "kubectl"}},
+		}
+	}
+	return []runtime.Object{
+		&unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "v1",
+			"kind":       "Namespace",
+			"metadata":   map[string]any{"name": namespace, "uid": "d9f1e4a0-0000-0000-0000-000000000001"},
+			"status":     map[string]any{"phase": "Active"},
+		}},
+		&unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   metadata("config"),
+			"data":       map[string]any{"foo": "bar"},
+		}},
+		&unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "v1",
+			"kind":       "Event",
+			"metadata":   metadata("config.1"),
+		}},
+		&unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"metadata":   metadata("web"),
+			"spec":       map[string]any{"replicas": int64(1)},
+			"status":     map[string]any{"replicas": int64(1)},
+		}},
+		&unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   map[string]any{"name": "other", "namespace": "other"},
+		}},
+	}
+}
+
+func dynamicClient(objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Version: "v1", Resource: "namespaces"}:                                "NamespaceList",
+		{Version: "v1", Resource: "configmaps"}:                                "ConfigMapList",
+		{Version: "v1", Resource: "secrets"}:                                   "SecretList",
+		{Version: "v1", Resource: "serviceaccounts"}:                           "ServiceAccountList",
+		{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "roles"}: "RoleList",
+		{Version: "v1", Resource: "events"}:                                    "EventList",
+		{Version: "v1", Resource: "pods"}:                                      "PodList",
+		{Version: "v1", Resource: "services"}:                                  "ServiceList",
+		{Version: "v1", Resource: "persistentvolumeclaims"}:                    "PersistentVolumeClaimList",
+		{Group: "apps", Version: "v1", Resource: "deployments"}:                "DeploymentList",
+	}, objects...)
+}
+
+func readArchive(t *testing.T, path string) map[string]string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Unexpected error opening archive: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Unexpected error reading archive: %v", err)
+	}
+	tr := tar.NewReader(gz)
+	files := make(map[string]string)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error reading archive: %v", err)
+		}
+		data, _ := io.ReadAll(tr)
+		files[header.Name] = string(data)
+	}
+	return files
+}
+
+func TestArchiveNamespace(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := kingpin.CommandLine.Parse([]string{"--archive-dir=" + dir}); err != nil {
+		t.Fatal(err)
+	}
+	timeNow = func() time.Time {
+		return creationTime.Add((time.Hour * 24 * 9))
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	clientset := clientset()
+	archiveResources(clientset)
+
+	archive, err := archiveNamespace(context.Background(), clientset.Discovery(), dynamicClient(archiveObjects("user-user2")...), "user-user2", logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := filepath.Join(dir, "user-user2-20200110T130000Z.tar.gz"); archive != expected {
+		t.Errorf("Unexpected archive\nExpected: %s\nGot: %s", expected, archive)
+	}
+	files := readArchive(t, archive)
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	expected := []string{"configmaps/config.yaml", "deployments.apps/web.yaml", "namespace.yaml"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Unexpected archive contents\nExpected: %v\nGot: %v", expected, names)
+	}
+	expectedConfigMap := `apiVersion: v1
+data:
+  foo: bar
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: user-user2
+`
+	if files["configmaps/config.yaml"] != expectedConfigMap {
+		t.Errorf("Unexpected config map\nExpected: %s\nGot: %s", expectedConfigMap, files["configmaps/config.yaml"])
+	}
+	for name, data := range files {
+		for _, field := range []string{"uid", "resourceVersion", "managedFields", "status"} {
+			if strings.Contains(data, field) {
+				t.Errorf("Archived %s contains %s:\n%s", name, field, data)
+			}
+		}
+	}
+}
+
+// unavailableDiscovery fails to discover the resources of one group version like an unavailable aggregated API
+type unavailableDiscovery struct {
+	*fakediscovery.FakeDiscovery
+	groupVersion string
+}
+
+func (d unavailableDiscovery) ServerResourcesForGroupVersion(groupVersion string) (*metav1.APIResourceList, error) {
+	if groupVersion == d.groupVersion {
+		return nil, errors.New("the server is currently unable to handle the request")
+	}
+	return d.FakeDiscovery.ServerResourcesForGroupVersion(groupVersion)
+}
+
+func TestArchiveNamespaceDiscoveryFailure(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := kingpin.CommandLine.Parse([]string{"--archive-dir=" + dir}); err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	clientset := clientset()
+	archiveResources(clientset)
+	fake := clientset.Discovery().(*fakediscovery.FakeDiscovery)
+	fake.Resources = append(fake.Resources, &metav1.APIResourceList{
+		GroupVersion: "metrics.k8s.io/v1beta1",
+		APIResources: []metav1.APIResource{{Name: "pods", Kind: "PodMetrics", Namespaced: true, Verbs: []string{"get", "list"}}},
+	})
+	failuresBefore := testutil.ToFloat64(metricArchiveDiscoveryFailuresTotal.WithLabelValues("metrics.k8s.io/v1beta1"))
+
+	archive, err := archiveNamespace(context.Background(), unavailableDiscovery{FakeDiscovery: fake, groupVersion: "metrics.k8s.io/v1beta1"}, dynamicClient(archiveObjects("user-user2")...), "user-user2", logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := readArchive(t, archive)["configmaps/config.yaml"]; !ok {
+		t.Errorf("Resources of discovered groups not archived")
+	}
+	if failures := testutil.ToFloat64(metricArchiveDiscoveryFailuresTotal.WithLabelValues("metrics.k8s.io/v1beta1")) - failuresBefore; failures != 1 {
+		t.Errorf("Unexpected discovery failures: %v", failures)
+	}
+}
+
+func TestArchiveNamespaceError(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := kingpin.CommandLine.Parse([]string{"--archive-dir=" + dir}); err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	clientset := clientset()
+	archiveResources(clientset)
+	client := dynamicClient(archiveObjects("user-user2")...)
+	client.PrependReactor("list", "deployments", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("forbidden")
+	})
+
+	if _, err := archiveNamespace(context.Background(), clientset.Discovery(), client, "user-user2", logger); err == nil {
+		t.Errorf("Expected error")
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("Unexpected files left in archive dir: %v", entries)
+	}
+}
+
+func TestPruneArchives(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := kingpin.CommandLine.Parse([]string{"--archive-dir=" + dir, "--archive-retention=48h"}); err != nil {
+		t.Fatal(err)
+	}
+	timeNow = func() time.Time {
+		return creationTime.Add((time.Hour * 24 * 9))
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	for _, name := range []string{"user-user1-20200101T130000Z.tar.gz", "user-user2-20200109T130000Z.tar.gz", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if errCount := pruneArchives(logger); errCount != 0 {
+		t.Errorf("Unexpected error count: %d", errCount)
+	}
+	var names []string
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	expected := []string{"notes.txt", "user-user2-20200109T130000Z.tar.gz"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Unexpected files\nExpected: %v\nGot: %v", expected, names)
+	}
+}
+
+func TestRunArchive(t *testing.T) {
+	queryResults, err := os.ReadFile("testdata/prometheus-query.json")
+	if err != nil {
+		t.Fatalf("Error loading fixture data: %s", err.Error())
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write(queryResults)
+	}))
+	defer server.Close()
+	address, _ := url.Parse(server.URL)
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	timeNow = func() time.Time {
+		return creationTime.Add((time.Hour * 24 * 9))
+	}
+
+	tests := []struct {
+		name   string
+		client func() dynamic.Interface
+		reaped bool
+	}{
+		{name: "archived", client: func() dynamic.Interface { return dynamicClient(archiveObjects("user-user2")...) }, reaped: true},
+		{name: "failed", client: func() dynamic.Interface { return dynamicClient() }, reaped: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			args := []string{
+				"--namespace-labels=app.kubernetes.io/name=open-ondemand",
+				fmt.Sprintf("--prometheus-address=%s", address),
+				"--archive-dir=" + dir,
+			}
+			if _, err := kingpin.CommandLine.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+			clientset := clientset()
+			archiveResources(clientset)
+			err := run(clientset, test.client(), logger)
+			if test.reaped && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			} else if !test.reaped && err == nil {
+				t.Errorf("Expected error")
+			}
+			_, err = clientset.CoreV1().Namespaces().Get(context.TODO(), "user-user2", metav1.GetOptions{})
+			if reaped := err != nil; reaped != test.reaped {
+				t.Errorf("Unexpected reaped, expected: %v got: %v", test.reaped, reaped)
+			}
+			archives, _ := filepath.Glob(filepath.Join(dir, "*.tar.gz"))
+			if archived := len(archives) == 1; archived != test.reaped {
+				t.Errorf("Unexpected archives: %v", archives)
+			}
+		})
+	}
+}
@@ -0,0 +1,430 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/common/version"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	auditResultReaped  = "reaped"
+	auditResultSkipped = "skipped"
+	auditResultFailed  = "failed"
+	auditConfigMapKey  = "audit.jsonl"
+	historyOutputTable = "table"
+	historyOutputJSON  = "json"
+	// auditConfigMapMaxBytes leaves room within the 1MiB limit of a ConfigMap for its metadata
+	auditConfigMapMaxBytes = 900 * 1024
+)
+
+// AuditSink durably records the outcome of reaping namespaces
+type AuditSink interface {
+	Name() string
+	Write(ctx context.Context, record auditRecord) error
+}
+
+// auditRecord is one entry of the audit trail, written as a single line of JSON
+type auditRecord struct {
+	Time         time.Time         `json:"time"`
+	Namespace    string            `json:"namespace"`
+	UID          types.UID         `json:"uid"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	Created      time.Time         `json:"created"`
+	LastActivity *time.Time        `json:"lastActivity,omitempty"`
+	Policy       auditPolicy       `json:"policy"`
+	Reason       string            `json:"reason"`
+	Reaper       auditReaper       `json:"reaper"`
+	Action       string            `json:"action"`
+	Archive      string            `json:"archive,omitempty"`
+	Result       string            `json:"result"`
+	Skipped      string            `json:"skipped,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// auditPolicy is the policy a namespace was reaped under
+type auditPolicy struct {
+	ReapAfter         string `json:"reapAfter"`
+	IdleThreshold     string `json:"idleThreshold"`
+	LastUsedThreshold string `json:"lastUsedThreshold,omitempty"`
+	GracePeriod       string `json:"gracePeriod,omitempty"`
+}
+
+// auditReaper identifies the reaper that reaped a namespace
+type auditReaper struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+	Version   string `json:"version"`
+}
+
+// newAuditRecord builds the audit record of an attempt to reap a namespace
+func newAuditRecord(namespace namespaceCandidate, entry planEntry, action string, result deleteResult, err error) auditRecord {
+	record := auditRecord{
+		Time:         timeNow(),
+		Namespace:    namespace.Name,
+		UID:          namespace.UID,
+		Labels:       namespace.Labels,
+		Annotations:  namespace.Annotations,
+		Created:      namespace.Created,
+		LastActivity: namespace.LastActivity,
+		Policy: auditPolicy{
+			ReapAfter:     namespace.ReapAfter.String(),
+			IdleThreshold: idleAfter().String(),
+		},
+		Reason:  entry.Reason,
+		Reaper:  reaperIdentity(),
+		Action:  action,
+		Archive: entry.Archive,
+		Skipped: entry.Skipped,
+	}
+	if *namespaceLastUsedAnnotation != "" {
+		record.Policy.LastUsedThreshold = (*lastUsedThreshold).String()
+	}
+	if *gracePeriod > 0 {
+		record.Policy.GracePeriod = (*gracePeriod).String()
+	}
+	switch result {
+	case deleteReaped:
+		record.Result = auditResultReaped
+	case deleteSkipped:
+		record.Result = auditResultSkipped
+	default:
+		record.Result = auditResultFailed
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	return record
+}
+
+// reaperIdentity returns the reaper's Pod when known and otherwise the host it runs on
+func reaperIdentity() auditReaper {
+	reaper := auditReaper{Name: *podName, Namespace: *podNamespace, Version: version.Version}
+	if reaper.Name == "" {
+		reaper.Name, _ = os.Hostname()
+	}
+	return reaper
+}
+
+func getAuditSinks(clientset kubernetes.Interface) []AuditSink {
+	var sinks []AuditSink
+	if *auditFile != "" {
+		sinks = append(sinks, &fileAuditSink{path: *auditFile, maxSize: int64(*auditFileMaxSize), maxFiles: *auditFileMaxFiles})
+	}
+	if *auditConfigMap != "" {
+		sinks = append(sinks, &configMapAuditSink{clientset: clientset, namespace: auditConfigMapNamespaceName(), name: *auditConfigMap, maxRecords: *auditConfigMapMaxRecords, maxBytes: auditConfigMapMaxBytes})
+	}
+	return sinks
+}
+
+// audit writes a record to every audit sink, returning the number of sinks that failed
+func audit(sinks []AuditSink, record auditRecord, logger *slog.Logger) int {
+	errCount := 0
+	for _, sink := range sinks {
+		if err := sink.Write(context.Background(), record); err != nil {
+			errCount++
+			metricAuditRecordsTotal.WithLabelValues(sink.Name(), "error").Inc()
+			metricErrorsTotal.Inc()
+			logger.Error("Error writing audit record", "sink", sink.Name(), "err", err)
+			continue
+		}
+		metricAuditRecordsTotal.WithLabelValues(sink.Name(), "success").Inc()
+	}
+	return errCount
+}
+
+// validateAudit checks the audit flags
+func validateAudit() []error {
+	var errs []error
+	if *auditFileMaxSize < 0 {
+		errs = append(errs, errors.New("audit file max size must not be negative"))
+	}
+	if *auditFileMaxFiles < 1 {
+		errs = append(errs, errors.New("audit file max files must be at least 1"))
+	}
+	if *auditConfigMap != "" && auditConfigMapNamespaceName() == "" {
+		errs = append(errs, errors.New("must provide audit configmap namespace or pod namespace when using audit configmap"))
+	}
+	if *auditConfigMapMaxRecords < 1 {
+		errs = append(errs, errors.New("audit configmap max records must be at least 1"))
+	}
+	return errs
+}
+
+// auditConfigMapNamespaceName returns the namespace of the audit ConfigMap, by default the reaper's own namespace
+func auditConfigMapNamespaceName() string {
+	if *auditConfigMapNamespace != "" {
+		return *auditConfigMapNamespace
+	}
+	return *podNamespace
+}
+
+// fileAuditSink appends records as JSON Lines to a file, rotating the file once it reaches the maximum size
+type fileAuditSink struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+}
+
+func (s *fileAuditSink) Name() string {
+	return "file"
+}
+
+// Write appends a record to the audit file and syncs it to disk before returning
+func (s *fileAuditSink) Write(ctx context.Context, record auditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if info, err := os.Stat(s.path); err == nil && s.maxSize > 0 && info.Size() > 0 && info.Size()+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return fmt.Errorf("error rotating audit file: %w", err)
+		}
+	}
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rotate renames the audit file to <file>.1, shifting older files up and removing those beyond the maximum files
+func (s *fileAuditSink) rotate() error {
+	if err := os.Remove(rotatedAuditFile(s.path, s.maxFiles)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for i := s.maxFiles; i > 0; i-- {
+		if err := os.Rename(rotatedAuditFile(s.path, i-1), rotatedAuditFile(s.path, i)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// rotatedAuditFile returns the path of a rotated audit file, 0 is the current file
+func rotatedAuditFile(path string, i int) string {
+	if i == 0 {
+		return path
+	}
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// configMapAuditSink appends records as JSON Lines to a ConfigMap, keeping only the newest records that fit
+// within the maximum records and bytes as a ConfigMap is limited to 1MiB
+type configMapAuditSink struct {
+	mu         sync.Mutex
+	clientset  kubernetes.Interface
+	namespace  string
+	name       string
+	maxRecords int
+	maxBytes   int
+}
+
+func (s *configMapAuditSink) Name() string {
+	return "configmap"
+}
+
+// Write appends a record to the ConfigMap, creating the ConfigMap if it does not exist
+func (s *configMapAuditSink) Write(ctx context.Context, record auditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, *deleteTimeout)
+	defer cancel()
+	configMaps := s.clientset.CoreV1().ConfigMaps(s.namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, err := configMaps.Get(ctx, s.name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			configMap = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      s.name,
+					Namespace: s.namespace,
+					Labels:    map[string]string{"app.kubernetes.io/name": appName},
+				},
+				Data: map[string]string{auditConfigMapKey: string(line) + "\n"},
+			}
+			_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// Another writer created it first, retry as a conflict so the record is appended
+				return apierrors.NewConflict(corev1.Resource("configmaps"), s.name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		var lines []string
+		if data := strings.TrimSpace(configMap.Data[auditConfigMapKey]); data != "" {
+			lines = strings.Split(data, "\n")
+		}
+		lines = append(lines, string(line))
+		if len(lines) > s.maxRecords {
+			lines = lines[len(lines)-s.maxRecords:]
+		}
+		size := 0
+		for _, l := range lines {
+			size += len(l) + 1
+		}
+		// The newest record is always kept, a record too large for the ConfigMap fails to be written
+		for len(lines) > 1 && size > s.maxBytes {
+			size -= len(lines[0]) + 1
+			lines = lines[1:]
+		}
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		configMap.Data[auditConfigMapKey] = strings.Join(lines, "\n") + "\n"
+		_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// history writes the audit records matching the history filters, oldest first
+func history(clientset kubernetes.Interface, w io.Writer, logger *slog.Logger) error {
+	var records []auditRecord
+	var err error
+	switch {
+	case *auditFile != "":
+		records, err = readAuditFiles(*auditFile, *auditFileMaxFiles, logger)
+	case *auditConfigMap != "":
+		records, err = readAuditConfigMap(clientset, logger)
+	default:
+		return errors.New("must provide audit file or audit configmap to show history")
+	}
+	if err != nil {
+		return err
+	}
+	var since time.Time
+	if *historySince > 0 {
+		since = timeNow().Add(-*historySince)
+	}
+	var matched []auditRecord
+	for _, record := range records {
+		if *historyNamespace != "" && record.Namespace != *historyNamespace {
+			continue
+		}
+		if *historyResult != "" && record.Result != *historyResult {
+			continue
+		}
+		if record.Time.Before(since) {
+			continue
+		}
+		matched = append(matched, record)
+	}
+	if *historyOutput == historyOutputJSON {
+		encoder := json.NewEncoder(w)
+		for _, record := range matched {
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tNAMESPACE\tACTION\tRESULT\tREAPER\tREASON")
+	for _, record := range matched {
+		reason := record.Reason
+		if record.Skipped != "" {
+			reason = record.Skipped
+		}
+		if record.Error != "" {
+			reason = record.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", record.Time.UTC().Format(time.RFC3339), record.Namespace, record.Action, record.Result, record.Reaper.Name, reason)
+	}
+	return tw.Flush()
+}
+
+// readAuditFiles reads the records of an audit file and its rotated files, oldest first
+func readAuditFiles(path string, maxFiles int, logger *slog.Logger) ([]auditRecord, error) {
+	var records []auditRecord
+	for i := maxFiles; i >= 0; i-- {
+		data, err := os.ReadFile(rotatedAuditFile(path, i))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, parseAuditRecords(data, logger.With("file", rotatedAuditFile(path, i)))...)
+	}
+	return records, nil
+}
+
+func readAuditConfigMap(clientset kubernetes.Interface, logger *slog.Logger) ([]auditRecord, error) {
+	configMap, err := clientset.CoreV1().ConfigMaps(auditConfigMapNamespaceName()).Get(context.TODO(), *auditConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseAuditRecords([]byte(configMap.Data[auditConfigMapKey]), logger.With("configmap", *auditConfigMap)), nil
+}
+
+// parseAuditRecords parses JSON Lines audit records, lines that can not be parsed such as a partially written
+// last line are logged and skipped
+func parseAuditRecords(data []byte, logger *slog.Logger) []auditRecord {
+	var records []auditRecord
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var record auditRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			logger.Warn("Skipping audit record that could not be parsed", "line", n, "err", err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records
+}
@@ -0,0 +1,227 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestReapAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	args := []string{"--namespace-labels=app.kubernetes.io/name=open-ondemand", "--pod-name=reaper", "--pod-namespace=k8-namespace-reaper", "--audit-file=" + path, "--audit-configmap=audit"}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	timeNow = func() time.Time {
+		return creationTime.Add((time.Hour * 24 * 9))
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	clientset := clientset()
+	namespace, err := clientset.CoreV1().Namespaces().Get(context.TODO(), "user-user2", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidate, ok := evaluateNamespace(*namespace, labels.Nothing(), logger)
+	if !ok {
+		t.Fatal("Expected namespace to be a candidate")
+	}
+	if errCount := reap([]namespaceCandidate{candidate}, clientset, nil, namespaceDeleter{}, nil, getAuditSinks(clientset), logger); errCount != 0 {
+		t.Errorf("Unexpected errors: %d", errCount)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error reading audit file: %v", err)
+	}
+	var record auditRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		t.Fatalf("Unexpected error decoding audit record: %v", err)
+	}
+	if record.Namespace != "user-user2" || record.Result != auditResultReaped || record.Action != reapActionDelete {
+		t.Errorf("Unexpected audit record: %s", data)
+	}
+	if !record.Created.Equal(creationTime.Add(time.Hour*24)) || record.Labels["app.kubernetes.io/name"] != "open-ondemand" {
+		t.Errorf("Unexpected namespace details in audit record: %s", data)
+	}
+	if record.Reaper.Name != "reaper" || record.Reaper.Namespace != "k8-namespace-reaper" || record.Policy.ReapAfter != "168h0m0s" {
+		t.Errorf("Unexpected reaper or policy in audit record: %s", data)
+	}
+
+	configMap, err := clientset.CoreV1().ConfigMaps("k8-namespace-reaper").Get(context.TODO(), "audit", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error getting audit configmap: %v", err)
+	}
+	if configMap.Data[auditConfigMapKey] != string(data) {
+		t.Errorf("Unexpected audit configmap data\nExpected: %s\nGot: %s", data, configMap.Data[auditConfigMapKey])
+	}
+}
+
+func TestFileAuditSinkRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	record := auditRecord{Namespace: "user-user1", Result: auditResultReaped}
+	line, _ := json.Marshal(record)
+	// Each file holds two records
+	sink := &fileAuditSink{path: path, maxSize: int64(len(line)+1) * 2, maxFiles: 2}
+	for i := 0; i < 7; i++ {
+		record.Time = creationTime.Add(time.Duration(i) * time.Hour)
+		if err := sink.Write(context.Background(), record); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	files, _ := filepath.Glob(path + "*")
+	expectedFiles := []string{path, path + ".1", path + ".2"}
+	if !reflect.DeepEqual(files, expectedFiles) {
+		t.Errorf("Unexpected files\nExpected: %v\nGot: %v", expectedFiles, files)
+	}
+	records, err := readAuditFiles(path, 2, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The oldest two records were rotated out
+	if len(records) != 5 || !records[0].Time.Equal(creationTime.Add(time.Hour*2)) || !records[4].Time.Equal(creationTime.Add(time.Hour*6)) {
+		t.Errorf("Unexpected records: %v", records)
+	}
+}
+
+func TestConfigMapAuditSinkMaxRecords(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "audit", Namespace: "k8-namespace-reaper"},
+	})
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	sink := &configMapAuditSink{clientset: clientset, namespace: "k8-namespace-reaper", name: "audit", maxRecords: 2, maxBytes: auditConfigMapMaxBytes}
+	for _, namespace := range []string{"user-user1", "user-user2", "user-user3"} {
+		if err := sink.Write(context.Background(), auditRecord{Namespace: namespace}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	configMap, err := clientset.CoreV1().ConfigMaps("k8-namespace-reaper").Get(context.TODO(), "audit", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := parseAuditRecords([]byte(configMap.Data[auditConfigMapKey]), slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	if len(records) != 2 || records[0].Namespace != "user-user2" || records[1].Namespace != "user-user3" {
+		t.Errorf("Unexpected records: %v", records)
+	}
+}
+
+func TestConfigMapAuditSinkMaxBytes(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	sink := &configMapAuditSink{clientset: clientset, namespace: "k8-namespace-reaper", name: "audit", maxRecords: 1000, maxBytes: auditConfigMapMaxBytes}
+	annotations := map[string]string{"description": strings.Repeat("x", 100*1024)}
+	for i := 0; i < 20; i++ {
+		record := auditRecord{Time: creationTime.Add(time.Duration(i) * time.Hour), Namespace: "user-user1", Annotations: annotations}
+		if err := sink.Write(context.Background(), record); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	configMap, err := clientset.CoreV1().ConfigMaps("k8-namespace-reaper").Get(context.TODO(), "audit", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := configMap.Data[auditConfigMapKey]
+	if len(data) > auditConfigMapMaxBytes {
+		t.Errorf("Audit configmap data exceeds max bytes: %d", len(data))
+	}
+	records := parseAuditRecords([]byte(data), slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	// Each record is just over 100KiB so only the newest 8 fit
+	if len(records) != 8 || !records[0].Time.Equal(creationTime.Add(time.Hour*12)) || !records[7].Time.Equal(creationTime.Add(time.Hour*19)) {
+		t.Errorf("Unexpected records, got %d", len(records))
+	}
+}
+
+func TestHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	records := []auditRecord{
+		{Time: creationTime, Namespace: "user-user1", Action: reapActionDelete, Result: auditResultReaped, Reason: "idle", Reaper: auditReaper{Name: "reaper"}},
+		{Time: creationTime.Add(time.Hour * 24), Namespace: "user-user2", Action: reapActionDelete, Result: auditResultSkipped, Skipped: "namespace has running pods", Reaper: auditReaper{Name: "reaper"}},
+		{Time: creationTime.Add(time.Hour * 48), Namespace: "user-user1", Action: reapActionDelete, Result: auditResultFailed, Error: "timed out", Reaper: auditReaper{Name: "reaper"}},
+	}
+	var data []byte
+	for _, record := range records {
+		line, _ := json.Marshal(record)
+		data = append(append(data, line...), '\n')
+	}
+	// A partially written line is skipped
+	data = append(data, []byte(`{"namespace": "user-`)...)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	timeNow = func() time.Time {
+		return creationTime.Add(time.Hour * 72)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{
+			name: "all",
+			args: []string{"history"},
+			expected: `TIME                  NAMESPACE   ACTION  RESULT   REAPER  REASON
+2020-01-01T13:00:00Z  user-user1  delete  reaped   reaper  idle
+2020-01-02T13:00:00Z  user-user2  delete  skipped  reaper  namespace has running pods
+2020-01-03T13:00:00Z  user-user1  delete  failed   reaper  timed out
+`,
+		},
+		{
+			name: "namespace",
+			args: []string{"history", "user-user1", "--result=failed"},
+			expected: `TIME                  NAMESPACE   ACTION  RESULT  REAPER  REASON
+2020-01-03T13:00:00Z  user-user1  delete  failed  reaper  timed out
+`,
+		},
+		{
+			name: "since",
+			args: []string{"history", "--since=36h", "--output=json"},
+			expected: `{"time":"2020-01-03T13:00:00Z","namespace":"user-user1","uid":"","created":"0001-01-01T00:00:00Z","policy":{"reapAfter":"","idleThreshold":""},"reason":"","reaper":{"name":"reaper","version":""},"action":"delete","result":"failed","error":"timed out"}
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := kingpin.CommandLine.Parse(append(test.args, "--audit-file="+path)); err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			if err := history(nil, &out, logger); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if out.String() != test.expected {
+				t.Errorf("Unexpected output\nExpected:\n%s\nGot:\n%s", test.expected, out.String())
+			}
+		})
+	}
+}
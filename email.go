@@ -0,0 +1,275 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/common/config"
+)
+
+const (
+	smtpTLSNone     = "none"
+	smtpTLSStartTLS = "starttls"
+	smtpTLSTLS      = "tls"
+
+	defaultEmailSubjectTemplate = `{{if eq .Event "warned"}}Namespace {{.Namespace}} is scheduled for {{if eq .Action "quarantine"}}quarantine{{else}}deletion{{end}}` +
+		`{{else if eq .Event "reaped"}}Namespace {{.Namespace}} has been {{if eq .Action "quarantine"}}quarantined{{else}}deleted{{end}}` +
+		`{{else}}Failed to {{.Action}} namespace {{.Namespace}}{{end}}`
+	defaultEmailBodyTemplate = `{{if eq .Event "warned"}}The namespace {{.Namespace}} has been idle for {{.Idle}} and is scheduled for {{if eq .Action "quarantine"}}quarantine{{else}}deletion{{end}} at {{.ScheduledDeletion.UTC.Format "2006-01-02 15:04 MST"}}.
+Using the namespace before then will prevent it from being {{if eq .Action "quarantine"}}quarantined{{else}}deleted{{end}}.
+{{else if eq .Event "reaped"}}{{if eq .Action "quarantine"}}The namespace {{.Namespace}} has been quarantined after being idle for {{.Idle}}, its workloads were scaled to zero and network traffic is denied. Its data has not been deleted.
+{{else}}The namespace {{.Namespace}} has been deleted after being idle for {{.Idle}}.
+{{end}}{{else}}The namespace {{.Namespace}} could not be {{if eq .Action "quarantine"}}quarantined{{else}}deleted{{end}}: {{.Error}}
+{{end}}
+Reason: {{.Reason}}
+`
+)
+
+type emailNotifier struct {
+	logger *slog.Logger
+}
+
+// emailData is passed to email templates
+type emailData struct {
+	notification
+	Owner string
+}
+
+func (e *emailNotifier) Name() string {
+	return "email"
+}
+
+func (e *emailNotifier) Enabled(event string) bool {
+	return notifyEnabled(*emailEvents, event)
+}
+
+// Notify emails the owner of the namespace
+func (e *emailNotifier) Notify(ctx context.Context, n notification) error {
+	owner, err := namespaceOwner(n.Namespace, n.Annotations)
+	if err != nil {
+		return err
+	}
+	message, err := emailMessage(emailData{notification: n, Owner: owner})
+	if err != nil {
+		return err
+	}
+	if err := sendEmail(ctx, owner, message); err != nil {
+		return err
+	}
+	e.logger.Debug("Sent email notification", "namespace", n.Namespace, "event", n.Event, "owner", owner)
+	return nil
+}
+
+// namespaceOwner resolves the email address of a namespace owner from the owner annotation
+// or the first capture group of the owner regexp, appending the email domain to user names
+func namespaceOwner(namespace string, annotations map[string]string) (string, error) {
+	var owner string
+	if *emailOwnerAnnotation != "" {
+		owner = annotations[*emailOwnerAnnotation]
+	}
+	if owner == "" && *emailOwnerRegexp != "" {
+		re, err := regexp.Compile(*emailOwnerRegexp)
+		if err != nil {
+			return "", err
+		}
+		if match := re.FindStringSubmatch(namespace); len(match) > 1 {
+			owner = match[1]
+		}
+	}
+	if owner == "" {
+		return "", fmt.Errorf("unable to determine owner of namespace %s", namespace)
+	}
+	if !strings.Contains(owner, "@") {
+		if *emailDomain == "" {
+			return "", fmt.Errorf("owner %s of namespace %s is not an email address and no email domain is set", owner, namespace)
+		}
+		owner = fmt.Sprintf("%s@%s", owner, strings.TrimPrefix(*emailDomain, "@"))
+	}
+	return owner, nil
+}
+
+func emailTemplates() (*template.Template, *template.Template, error) {
+	subject, err := template.New("subject").Parse(*emailSubjectTemplate)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid email subject template: %w", err)
+	}
+	body, err := template.New("body").Parse(*emailBodyTemplate)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid email body template: %w", err)
+	}
+	return subject, body, nil
+}
+
+// emailMessage renders the email headers and body
+func emailMessage(data emailData) ([]byte, error) {
+	subjectTmpl, bodyTmpl, err := emailTemplates()
+	if err != nil {
+		return nil, err
+	}
+	var subject, body bytes.Buffer
+	if err := subjectTmpl.Execute(&subject, data); err != nil {
+		return nil, fmt.Errorf("error rendering email subject template: %w", err)
+	}
+	if err := bodyTmpl.Execute(&body, data); err != nil {
+		return nil, fmt.Errorf("error rendering email body template: %w", err)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", *emailFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", data.Owner)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject.String())))
+	fmt.Fprintf(&msg, "Date: %s\r\n", data.Time.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(body.String(), "\r\n", "\n"), "\n", "\r\n"))
+	return msg.Bytes(), nil
+}
+
+// sendEmail delivers a message to the SMTP server using implicit TLS, STARTTLS or no encryption
+func sendEmail(ctx context.Context, to string, message []byte) error {
+	host, _, err := net.SplitHostPort(*smtpAddress)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := smtpTLSConfig(host)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, *smtpTimeout)
+	defer cancel()
+	var conn net.Conn
+	dialer := &net.Dialer{}
+	if *smtpTLS == smtpTLSTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", *smtpAddress)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", *smtpAddress)
+	}
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if *smtpTLS == smtpTLSStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("SMTP server does not support STARTTLS")
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if *smtpUsername != "" {
+		password, err := smtpAuthPassword()
+		if err != nil {
+			return err
+		}
+		if err := client.Auth(smtp.PlainAuth("", *smtpUsername, password, host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(*emailFrom); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func smtpTLSConfig(host string) (*tls.Config, error) {
+	tlsConfig, err := config.NewTLSConfig(&config.TLSConfig{CAFile: *smtpCAFile, ServerName: host})
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP TLS configuration: %w", err)
+	}
+	return tlsConfig, nil
+}
+
+func smtpAuthPassword() (string, error) {
+	if *smtpPasswordFile == "" {
+		return *smtpPassword, nil
+	}
+	password, err := os.ReadFile(*smtpPasswordFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(password)), nil
+}
+
+// validateEmail checks the email notification flags
+func validateEmail() []error {
+	var errs []error
+	if *smtpAddress == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(*smtpAddress); err != nil {
+		errs = append(errs, fmt.Errorf("invalid SMTP address: %w", err))
+	}
+	if *smtpPassword != "" && *smtpPasswordFile != "" {
+		errs = append(errs, errors.New("SMTP password and password file can not both be set"))
+	}
+	if *emailFrom == "" {
+		errs = append(errs, errors.New("must provide email from address when sending email"))
+	}
+	if *emailOwnerAnnotation == "" && *emailOwnerRegexp == "" {
+		errs = append(errs, errors.New("must provide email owner annotation or email owner regexp when sending email"))
+	}
+	if *emailOwnerRegexp != "" {
+		if re, err := regexp.Compile(*emailOwnerRegexp); err != nil {
+			errs = append(errs, fmt.Errorf("invalid email owner regexp: %w", err))
+		} else if re.NumSubexp() < 1 {
+			errs = append(errs, errors.New("email owner regexp must have a capture group"))
+		}
+	}
+	if _, _, err := emailTemplates(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, event := range splitList(*emailEvents) {
+		switch event {
+		case notifyEventWarned, notifyEventReaped, notifyEventFailed:
+		default:
+			errs = append(errs, fmt.Errorf("unknown email event %q", event))
+		}
+	}
+	return errs
+}
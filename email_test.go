@@ -0,0 +1,290 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+)
+
+type smtpMessage struct {
+	Auth string
+	From string
+	To   string
+	TLS  bool
+	Data string
+}
+
+// smtpStandIn is a minimal in-process SMTP server that records received messages
+type smtpStandIn struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	mu        sync.Mutex
+	messages  []smtpMessage
+}
+
+func newSMTPStandIn(t *testing.T, tlsConfig *tls.Config) *smtpStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpStandIn{listener: listener, tlsConfig: tlsConfig}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	msg := smtpMessage{}
+	_ = tp.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			_ = tp.PrintfLine("250-localhost")
+			if s.tlsConfig != nil && !msg.TLS {
+				_ = tp.PrintfLine("250-STARTTLS")
+			}
+			_ = tp.PrintfLine("250 AUTH PLAIN")
+		case "STARTTLS":
+			_ = tp.PrintfLine("220 Ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			tp = textproto.NewConn(conn)
+			msg.TLS = true
+		case "AUTH":
+			fields := strings.Fields(line)
+			auth, _ := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+			msg.Auth = string(auth)
+			_ = tp.PrintfLine("235 Authenticated")
+		case "MAIL":
+			msg.From = strings.TrimPrefix(line, "MAIL FROM:")
+			_ = tp.PrintfLine("250 OK")
+		case "RCPT":
+			msg.To = strings.TrimPrefix(line, "RCPT TO:")
+			_ = tp.PrintfLine("250 OK")
+		case "DATA":
+			_ = tp.PrintfLine("354 Send data")
+			data, err := tp.ReadDotLines()
+			if err != nil {
+				return
+			}
+			msg.Data = strings.Join(data, "\n")
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			_ = tp.PrintfLine("250 OK")
+		case "QUIT":
+			_ = tp.PrintfLine("221 Bye")
+			return
+		default:
+			_ = tp.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+func (s *smtpStandIn) received() []smtpMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]smtpMessage{}, s.messages...)
+}
+
+func TestNamespaceOwner(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		namespace   string
+		annotations map[string]string
+		expected    string
+		expectErr   bool
+	}{
+		{name: "regexp", args: []string{"--email-owner-regexp=^user-(.+)$", "--email-domain=osc.edu"}, namespace: "user-user1", expected: "user1@osc.edu"},
+		{name: "regexp no match", args: []string{"--email-owner-regexp=^user-(.+)$", "--email-domain=osc.edu"}, namespace: "test", expectErr: true},
+		{name: "regexp no domain", args: []string{"--email-owner-regexp=^user-(.+)$"}, namespace: "user-user1", expectErr: true},
+		{name: "annotation", args: []string{"--email-owner-annotation=owner", "--email-owner-regexp=^user-(.+)$", "--email-domain=osc.edu"}, namespace: "user-user1", annotations: map[string]string{"owner": "someone@example.com"}, expected: "someone@example.com"},
+		{name: "annotation user", args: []string{"--email-owner-annotation=owner", "--email-domain=@osc.edu"}, namespace: "test", annotations: map[string]string{"owner": "user2"}, expected: "user2@osc.edu"},
+		{name: "annotation missing", args: []string{"--email-owner-annotation=owner", "--email-owner-regexp=^user-(.+)$", "--email-domain=osc.edu"}, namespace: "user-user1", expected: "user1@osc.edu"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := kingpin.CommandLine.Parse(test.args); err != nil {
+				t.Fatal(err)
+			}
+			owner, err := namespaceOwner(test.namespace, test.annotations)
+			if test.expectErr && err == nil {
+				t.Errorf("Expected error")
+			} else if !test.expectErr && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if owner != test.expected {
+				t.Errorf("Unexpected owner\nExpected: %s\nGot: %s", test.expected, owner)
+			}
+		})
+	}
+}
+
+func TestEmailNotify(t *testing.T) {
+	server := newSMTPStandIn(t, nil)
+	args := []string{
+		fmt.Sprintf("--smtp-address=%s", server.listener.Addr()),
+		"--smtp-tls=none",
+		"--smtp-username=reaper",
+		"--smtp-password=secret",
+		"--email-from=reaper@osc.edu",
+		"--email-owner-regexp=^user-(.+)$",
+		"--email-domain=osc.edu",
+	}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	notifier := &emailNotifier{logger: logger}
+	deleteAt := creationTime.Add(time.Hour * 24)
+	n := notification{
+		Event:             notifyEventWarned,
+		Namespace:         "user-user2",
+		Idle:              time.Hour * 168,
+		Reason:            "age 216h0m0s exceeds reap-after 168h0m0s",
+		ScheduledDeletion: &deleteAt,
+		Time:              creationTime,
+	}
+	if err := notifier.Notify(context.Background(), n); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	messages := server.received()
+	if len(messages) != 1 {
+		t.Fatalf("Unexpected number of messages, got: %d", len(messages))
+	}
+	msg := messages[0]
+	if msg.Auth != "\x00reaper\x00secret" {
+		t.Errorf("Unexpected auth: %q", msg.Auth)
+	}
+	if msg.From != "<reaper@osc.edu>" || msg.To != "<user2@osc.edu>" {
+		t.Errorf("Unexpected envelope: %s -> %s", msg.From, msg.To)
+	}
+	for _, expected := range []string{
+		"To: user2@osc.edu",
+		"Subject: Namespace user-user2 is scheduled for deletion",
+		"idle for 168h0m0s and is scheduled for deletion at 2020-01-02 13:00 UTC",
+		"Reason: age 216h0m0s exceeds reap-after 168h0m0s",
+	} {
+		if !strings.Contains(msg.Data, expected) {
+			t.Errorf("Message does not contain %q:\n%s", expected, msg.Data)
+		}
+	}
+
+	args = append(args, "--email-subject-template=Bye {{.Namespace}}", "--email-body-template={{.Owner}} {{.Event}}")
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	n.Event = notifyEventReaped
+	if err := notifier.Notify(context.Background(), n); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	messages = server.received()
+	if len(messages) != 2 {
+		t.Fatalf("Unexpected number of messages, got: %d", len(messages))
+	}
+	if !strings.Contains(messages[1].Data, "Subject: Bye user-user2") || !strings.HasSuffix(messages[1].Data, "\nuser2@osc.edu reaped") {
+		t.Errorf("Unexpected message:\n%s", messages[1].Data)
+	}
+}
+
+func TestEmailNotifyStartTLS(t *testing.T) {
+	tlsServer := httptest.NewUnstartedServer(http.NotFoundHandler())
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+	server := newSMTPStandIn(t, &tls.Config{Certificates: tlsServer.TLS.Certificates})
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	tests := []struct {
+		name      string
+		args      []string
+		expectErr bool
+	}{
+		{name: "untrusted", args: []string{}, expectErr: true},
+		{name: "ca", args: []string{"--smtp-ca-file=" + caFile}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := append([]string{
+				fmt.Sprintf("--smtp-address=%s", server.listener.Addr()),
+				"--email-from=reaper@osc.edu",
+				"--email-owner-regexp=^user-(.+)$",
+				"--email-domain=osc.edu",
+			}, test.args...)
+			if _, err := kingpin.CommandLine.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+			notifier := &emailNotifier{logger: logger}
+			err := notifier.Notify(context.Background(), notification{Event: notifyEventReaped, Namespace: "user-user1", Time: creationTime})
+			if test.expectErr && err == nil {
+				t.Errorf("Expected error")
+			} else if !test.expectErr && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+	messages := server.received()
+	if len(messages) != 1 || !messages[0].TLS {
+		t.Errorf("Unexpected messages: %+v", messages)
+	}
+}
+
+func TestValidateEmail(t *testing.T) {
+	args := []string{"--smtp-address=localhost", "--email-owner-regexp=^user-.+$", "--email-body-template={{ .Foo"}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if errs := validateEmail(); len(errs) != 4 {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/tools/reference"
+)
+
+const (
+	eventReasonReaping         = "Reaping"
+	eventReasonSkipped         = "ReapSkipped"
+	eventReasonHeldBack        = "ReapHeldBack"
+	eventReasonNamespaceReaped = "NamespaceReaped"
+	eventReasonRunCompleted    = "RunCompleted"
+	eventReasonRunFailed       = "RunFailed"
+	eventTimeout               = 10 * time.Second
+)
+
+// eventRecorder records Kubernetes events about reaper decisions, events are discarded until it is replaced
+// with one from newEventRecorder or newSyncEventRecorder
+var eventRecorder record.EventRecorder = &record.FakeRecorder{}
+
+// newEventRecorder returns an event recorder that creates events with the Kubernetes API in the background,
+// aggregating repeated events. Events still queued when the process exits are lost.
+func newEventRecorder(clientset kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: appName})
+}
+
+// newSyncEventRecorder returns an event recorder that creates each event with the Kubernetes API before returning,
+// used by commands that exit once they complete so their last events are not lost
+func newSyncEventRecorder(clientset kubernetes.Interface, logger *slog.Logger) record.EventRecorder {
+	return &syncEventRecorder{clientset: clientset, logger: logger}
+}
+
+type syncEventRecorder struct {
+	clientset kubernetes.Interface
+	logger    *slog.Logger
+}
+
+func (r *syncEventRecorder) Event(object runtime.Object, eventType string, reason string, message string) {
+	ref, err := reference.GetReference(scheme.Scheme, object)
+	if err != nil {
+		r.logger.Error("Error getting reference for event", "reason", reason, "err", err)
+		return
+	}
+	now := metav1.NewTime(timeNow())
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			// The wall clock keeps names unique even when the reaper's clock is fixed
+			Name:      fmt.Sprintf("%v.%x", ref.Name, time.Now().UnixNano()),
+			Namespace: ref.Namespace,
+		},
+		InvolvedObject: *ref,
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+		Source:         corev1.EventSource{Component: appName},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), eventTimeout)
+	defer cancel()
+	if _, err := r.clientset.CoreV1().Events(ref.Namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		r.logger.Error("Error creating event", "namespace", ref.Namespace, "reason", reason, "err", err)
+	}
+}
+
+func (r *syncEventRecorder) Eventf(object runtime.Object, eventType string, reason string, messageFmt string, args ...any) {
+	r.Event(object, eventType, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (r *syncEventRecorder) AnnotatedEventf(object runtime.Object, _ map[string]string, eventType string, reason string, messageFmt string, args ...any) {
+	r.Eventf(object, eventType, reason, messageFmt, args...)
+}
+
+// namespaceEvent records an event on a namespace, created in the namespace itself so it is shown when describing
+// the namespace. Nothing is recorded during a dry run as the reaping it would describe does not happen.
+func namespaceEvent(namespace string, uid types.UID, eventType string, reason string, messageFmt string, args ...any) {
+	if *dryRun {
+		return
+	}
+	ref := &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Namespace",
+		Name:       namespace,
+		Namespace:  namespace,
+		UID:        uid,
+	}
+	eventRecorder.Eventf(ref, eventType, reason, messageFmt, args...)
+}
+
+// skippedEvents remembers why each namespace was not reaped so a ReapSkipped event is only recorded when that changes
+var skippedEvents = &skipTracker{current: make(map[types.UID]string)}
+
+type skipTracker struct {
+	mu       sync.Mutex
+	previous map[types.UID]string
+	current  map[types.UID]string
+}
+
+// startRun begins a run, namespaces that were not skipped by the previous run are forgotten
+func (t *skipTracker) startRun() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.previous = t.current
+	t.current = make(map[types.UID]string)
+}
+
+// skip records the reason a namespace was not reaped during this run and returns if it differs from the previous run
+func (t *skipTracker) skip(uid types.UID, reason string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current[uid] == reason {
+		return false
+	}
+	t.current[uid] = reason
+	return t.previous[uid] != reason
+}
+
+// skippedEvent records a ReapSkipped event on a namespace unless it was skipped for the same reason by the previous run,
+// reason identifies why it was skipped while the message can change between runs
+func skippedEvent(namespace string, uid types.UID, reason string, messageFmt string, args ...any) {
+	if *dryRun || !skippedEvents.skip(uid, reason) {
+		return
+	}
+	namespaceEvent(namespace, uid, corev1.EventTypeNormal, eventReasonSkipped, messageFmt, args...)
+}
+
+// reaperEvent records an event about the reaper on its own Pod, nothing is recorded when the Pod is not known
+func reaperEvent(eventType string, reason string, messageFmt string, args ...any) {
+	if *podName == "" || *podNamespace == "" {
+		return
+	}
+	ref := &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Name:       *podName,
+		Namespace:  *podNamespace,
+		UID:        types.UID(*podUID),
+	}
+	eventRecorder.Eventf(ref, eventType, reason, messageFmt, args...)
+}
+
+// runEvent records the outcome of a run on the reaper's Pod
+func runEvent(err error) {
+	if err != nil {
+		reaperEvent(corev1.EventTypeWarning, eventReasonRunFailed, "Run failed: %v", err)
+		return
+	}
+	p := lastPlan.get()
+	reaped := 0
+	for _, entry := range p.Namespaces {
+		if entry.Reaped {
+			reaped++
+		}
+	}
+	// Scheduled, waiting and held back namespaces are in the plan but are not reaped by this run
+	message := fmt.Sprintf("Run completed, %d of %d namespaces reaped", reaped, p.count(actionReap))
+	if p.DryRun {
+		message = fmt.Sprintf("Dry run completed, %d namespaces would be reaped", p.count(actionReap))
+	}
+	reaperEvent(corev1.EventTypeNormal, eventReasonRunCompleted, message)
+}
@@ -0,0 +1,176 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// recordedEvents drains the events recorded by a fake recorder as "Type Reason" strings
+func recordedEvents(recorder *record.FakeRecorder) []string {
+	events := []string{}
+	for {
+		select {
+		case event := <-recorder.Events:
+			fields := strings.SplitN(event, " ", 3)
+			events = append(events, fields[0]+" "+fields[1])
+		default:
+			sort.Strings(events)
+			return events
+		}
+	}
+}
+
+func TestRunEvents(t *testing.T) {
+	queryResults, err := os.ReadFile("testdata/prometheus-query.json")
+	if err != nil {
+		t.Fatalf("Error loading fixture data: %s", err.Error())
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write(queryResults)
+	}))
+	defer server.Close()
+	address, _ := url.Parse(server.URL)
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	timeNow = func() time.Time {
+		return creationTime.Add((time.Hour * 24 * 9))
+	}
+	defer func() { eventRecorder = &record.FakeRecorder{} }()
+
+	// Each test runs twice against the same cluster to check which events are recorded again
+	tests := []struct {
+		name     string
+		args     []string
+		expected [][]string
+	}{
+		{
+			name: "reap",
+			args: []string{"--pod-name=reaper", "--pod-namespace=k8-namespace-reaper"},
+			expected: [][]string{
+				{"Normal RunCompleted", "Warning NamespaceReaped", "Warning Reaping"},
+				{"Normal RunCompleted"},
+			},
+		},
+		{
+			name: "recently used",
+			// The only namespace left to reap has no activity
+			args: []string{"--namespace-last-used-annotation=openondemand.org/last-hook-execution", "--last-used-threshold=240h", "--allow-empty-activity"},
+			expected: [][]string{
+				{"Normal ReapSkipped", "Warning Reaping"},
+				nil,
+			},
+		},
+		{
+			name: "held back",
+			args: []string{"--max-deletions-per-run=1", "--idle-threshold=30m"},
+			expected: [][]string{
+				{"Normal ReapHeldBack", "Warning Reaping"},
+				{"Warning Reaping"},
+			},
+		},
+		{
+			name:     "grace period",
+			args:     []string{"--grace-period=1h"},
+			expected: [][]string{{"Warning ScheduledForDeletion"}, nil},
+		},
+		{
+			name:     "dry run",
+			args:     []string{"--dry-run", "--pod-name=reaper", "--pod-namespace=k8-namespace-reaper"},
+			expected: [][]string{{"Normal RunCompleted"}, {"Normal RunCompleted"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := append([]string{
+				"--namespace-labels=app.kubernetes.io/name=open-ondemand",
+				fmt.Sprintf("--prometheus-address=%s", address),
+			}, test.args...)
+			if _, err := kingpin.CommandLine.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+			skippedEvents = &skipTracker{current: make(map[types.UID]string)}
+			clientset := clientset()
+			for i, runExpected := range test.expected {
+				recorder := record.NewFakeRecorder(100)
+				eventRecorder = recorder
+				err := run(clientset, nil, logger)
+				runEvent(err)
+				events := recordedEvents(recorder)
+				expected := append([]string{}, runExpected...)
+				sort.Strings(expected)
+				if !reflect.DeepEqual(events, expected) {
+					t.Errorf("Unexpected events for run %d\nExpected: %v\nGot: %v", i+1, expected, events)
+				}
+			}
+		})
+	}
+}
+
+func TestSyncEventRecorder(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--pod-name=reaper", "--pod-namespace=k8-namespace-reaper", "--pod-uid=uid-reaper"}); err != nil {
+		t.Fatal(err)
+	}
+	timeNow = func() time.Time {
+		return creationTime
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	clientset := fake.NewSimpleClientset()
+	eventRecorder = newSyncEventRecorder(clientset, logger)
+	defer func() { eventRecorder = &record.FakeRecorder{} }()
+	lastPlan.set(plan{})
+
+	namespaceEvent("user-user1", "uid-1", corev1.EventTypeWarning, eventReasonReaping, "Namespace is being reaped")
+	namespaceEvent("user-user1", "uid-1", corev1.EventTypeNormal, eventReasonSkipped, "Namespace not reaped")
+	runEvent(nil)
+
+	// Each event is created by the time recording returns
+	events, err := clientset.CoreV1().Events("user-user1").List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events.Items) != 2 {
+		t.Errorf("Unexpected namespace events: %v", events.Items)
+	}
+	for _, event := range events.Items {
+		if event.InvolvedObject.Kind != "Namespace" || event.InvolvedObject.UID != "uid-1" || event.Source.Component != appName {
+			t.Errorf("Unexpected namespace event: %+v", event)
+		}
+	}
+	events, err = clientset.CoreV1().Events("k8-namespace-reaper").List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events.Items) != 1 || events.Items[0].Reason != eventReasonRunCompleted || events.Items[0].InvolvedObject.Name != "reaper" {
+		t.Errorf("Unexpected reaper events: %v", events.Items)
+	}
+}
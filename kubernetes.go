@@ -0,0 +1,110 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// kubernetesSource uses pods, jobs and events from the Kubernetes API to determine namespace activity
+type kubernetesSource struct {
+	clientset kubernetes.Interface
+	logger    *slog.Logger
+}
+
+func (k *kubernetesSource) Name() string {
+	return "kubernetes"
+}
+
+func (k *kubernetesSource) LastActivity(ctx context.Context, namespaces []string) (map[string]time.Time, error) {
+	activity := make(map[string]time.Time)
+	now := timeNow()
+	since := now.Add(-*reapAfter)
+	for _, namespace := range namespaces {
+		lastActivity, err := k.namespaceActivity(ctx, namespace, now)
+		if err != nil {
+			k.logger.Error("Error getting namespace activity", "namespace", namespace, "err", err)
+			return nil, err
+		}
+		if lastActivity.After(since) {
+			activity[namespace] = lastActivity
+		}
+	}
+	return activity, nil
+}
+
+// namespaceActivity returns the newest activity time found in a namespace, pods or jobs that are still running are active now
+func (k *kubernetesSource) namespaceActivity(ctx context.Context, namespace string, now time.Time) (time.Time, error) {
+	var lastActivity time.Time
+	observe := func(t time.Time) {
+		if t.After(lastActivity) {
+			lastActivity = t
+		}
+	}
+	pods, err := k.clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return lastActivity, err
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodPending || pod.Status.Phase == corev1.PodRunning {
+			k.logger.Debug("Namespace has current pod", "namespace", namespace, "pod", pod.Name)
+			return now, nil
+		}
+		observe(pod.CreationTimestamp.Time)
+		if pod.Status.StartTime != nil {
+			observe(pod.Status.StartTime.Time)
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.State.Terminated != nil {
+				observe(status.State.Terminated.FinishedAt.Time)
+			}
+		}
+	}
+	jobs, err := k.clientset.BatchV1().Jobs(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return lastActivity, err
+	}
+	for _, job := range jobs.Items {
+		if job.Status.Active > 0 {
+			k.logger.Debug("Namespace has active job", "namespace", namespace, "job", job.Name)
+			return now, nil
+		}
+		if job.Status.StartTime != nil {
+			observe(job.Status.StartTime.Time)
+		}
+		if job.Status.CompletionTime != nil {
+			observe(job.Status.CompletionTime.Time)
+		}
+	}
+	events, err := k.clientset.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return lastActivity, err
+	}
+	for _, event := range events.Items {
+		// The reaper's own events, such as scheduling deletion, are not activity by users of the namespace
+		if event.Source.Component == appName || event.ReportingController == appName {
+			continue
+		}
+		observe(event.FirstTimestamp.Time)
+		observe(event.LastTimestamp.Time)
+		observe(event.EventTime.Time)
+	}
+	return lastActivity, nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestKubernetesLastActivity(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--activity-source=kubernetes", "--namespace-regexp=user-.+"}); err != nil {
+		t.Fatal(err)
+	}
+	now := creationTime.Add(time.Hour * 24 * 9)
+	timeNow = func() time.Time {
+		return now
+	}
+	recent := now.Add(-time.Hour * 24)
+	old := now.Add(-time.Hour * 24 * 8)
+	clientset := fake.NewSimpleClientset(
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "running", Namespace: "user-running", CreationTimestamp: metav1.NewTime(old)},
+			Status:     v1.PodStatus{Phase: v1.PodRunning},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "completed", Namespace: "user-completed", CreationTimestamp: metav1.NewTime(old)},
+			Status: v1.PodStatus{
+				Phase:     v1.PodSucceeded,
+				StartTime: &metav1.Time{Time: old},
+				ContainerStatuses: []v1.ContainerStatus{{
+					State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{FinishedAt: metav1.NewTime(recent)}},
+				}},
+			},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "old", Namespace: "user-old", CreationTimestamp: metav1.NewTime(old)},
+			Status:     v1.PodStatus{Phase: v1.PodFailed, StartTime: &metav1.Time{Time: old}},
+		},
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: "job", Namespace: "user-job", CreationTimestamp: metav1.NewTime(old)},
+			Status:     batchv1.JobStatus{StartTime: &metav1.Time{Time: old}, CompletionTime: &metav1.Time{Time: recent}},
+		},
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: "active", Namespace: "user-active-job", CreationTimestamp: metav1.NewTime(old)},
+			Status:     batchv1.JobStatus{Active: 1},
+		},
+		&v1.Event{
+			ObjectMeta:    metav1.ObjectMeta{Name: "event", Namespace: "user-event"},
+			LastTimestamp: metav1.NewTime(recent),
+		},
+		&v1.Event{
+			ObjectMeta:    metav1.ObjectMeta{Name: "reaper", Namespace: "user-reaper-event"},
+			Source:        v1.EventSource{Component: appName},
+			LastTimestamp: metav1.NewTime(recent),
+		},
+	)
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	source := &kubernetesSource{clientset: clientset, logger: logger}
+	namespaces := []string{"user-running", "user-completed", "user-old", "user-job", "user-active-job", "user-event", "user-reaper-event", "user-none"}
+	activity, err := source.LastActivity(context.Background(), namespaces)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := map[string]time.Time{
+		"user-running":    now,
+		"user-completed":  recent,
+		"user-job":        recent,
+		"user-active-job": now,
+		"user-event":      recent,
+	}
+	if !reflect.DeepEqual(activity, expected) {
+		t.Errorf("Unexpected activity\nExpected: %v\nGot: %v", expected, activity)
+	}
+}
+
+func TestRunKubernetesActivity(t *testing.T) {
+	args := []string{"--namespace-labels=app.kubernetes.io/name=open-ondemand", "--activity-source=kubernetes", "--dry-run"}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	now := creationTime.Add(time.Hour * 24 * 9)
+	timeNow = func() time.Time {
+		return now
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	clientset := clientset()
+	_, err := clientset.CoreV1().Pods("user-user1").Create(context.TODO(), &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "running", Namespace: "user-user1"},
+		Status:     v1.PodStatus{Phase: v1.PodRunning},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := run(clientset, nil, logger); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	p := lastPlan.get()
+	if len(p.Namespaces) != 1 || p.Namespaces[0].Namespace != "user-user2" {
+		t.Errorf("Unexpected plan: %+v", p.Namespaces)
+	}
+}
+
+func TestRunKubernetesActivityGracePeriod(t *testing.T) {
+	args := []string{"--namespace-labels=app.kubernetes.io/name=open-ondemand", "--activity-source=kubernetes", "--grace-period=1h"}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	now := creationTime.Add(time.Hour * 24 * 9)
+	timeNow = func() time.Time {
+		return now
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	clientset := clientset()
+	_, err := clientset.CoreV1().Pods("user-user1").Create(context.TODO(), &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "running", Namespace: "user-user1"},
+		Status:     v1.PodStatus{Phase: v1.PodRunning},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := run(clientset, nil, logger); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if p := lastPlan.get(); len(p.Namespaces) != 1 || p.Namespaces[0].Action != actionSchedule {
+		t.Errorf("Unexpected plan: %+v", p.Namespaces)
+	}
+
+	// The event recorded when scheduling must not count as activity that cancels the deletion
+	_, err = clientset.CoreV1().Events("user-user2").Create(context.TODO(), &v1.Event{
+		ObjectMeta:          metav1.ObjectMeta{Name: "scheduled", Namespace: "user-user2"},
+		Reason:              eventReasonScheduled,
+		Source:              v1.EventSource{Component: appName},
+		ReportingController: appName,
+		FirstTimestamp:      metav1.NewTime(now),
+		LastTimestamp:       metav1.NewTime(now),
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(90 * time.Minute)
+	if err := run(clientset, nil, logger); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := clientset.CoreV1().Namespaces().Get(context.TODO(), "user-user2", metav1.GetOptions{}); err == nil {
+		t.Errorf("Namespace user-user2 should have been reaped")
+	}
+}
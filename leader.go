@@ -0,0 +1,157 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	lockWaiting int32 = iota
+	lockHeld
+	lockTimedOut
+)
+
+// validateLeaderElection checks the leader election flags
+func validateLeaderElection() []error {
+	var errs []error
+	if !*leaderElect {
+		return nil
+	}
+	if leaderElectNamespaceName() == "" {
+		errs = append(errs, errors.New("must provide leader election namespace or pod namespace when using leader election"))
+	}
+	if *leaderElectLeaseDuration <= *leaderElectRenewDeadline {
+		errs = append(errs, errors.New("leader election lease duration must be greater than renew deadline"))
+	}
+	if *leaderElectRenewDeadline <= *leaderElectRetryPeriod {
+		errs = append(errs, errors.New("leader election renew deadline must be greater than retry period"))
+	}
+	if *leaderElectRetryPeriod <= 0 {
+		errs = append(errs, errors.New("leader election retry period must be greater than 0"))
+	}
+	return errs
+}
+
+// leaderElectNamespaceName returns the namespace of the leader election Lease, by default the reaper's own namespace
+func leaderElectNamespaceName() string {
+	if *leaderElectNamespace != "" {
+		return *leaderElectNamespace
+	}
+	return *podNamespace
+}
+
+// leaderElectionConfig returns the configuration to elect a leader with a Lease. The identity is unique to this process
+// so two runs on the same host can not both hold the Lease.
+func leaderElectionConfig(clientset kubernetes.Interface, callbacks leaderelection.LeaderCallbacks) leaderelection.LeaderElectionConfig {
+	identity := reaperIdentity().Name + "_" + string(uuid.NewUUID())
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      *leaderElectLeaseName,
+			Namespace: leaderElectNamespaceName(),
+		},
+		Client:     clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+	return leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   *leaderElectLeaseDuration,
+		RenewDeadline:   *leaderElectRenewDeadline,
+		RetryPeriod:     *leaderElectRetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            appName,
+		Callbacks:       callbacks,
+	}
+}
+
+// runAsLeader runs the reap loop only while this replica is the leader. Losing leadership exits so that a
+// reap run in progress can not overlap with one started by the new leader.
+func runAsLeader(clientset kubernetes.Interface, reapLoop func(), logger *slog.Logger) {
+	config := leaderElectionConfig(clientset, leaderelection.LeaderCallbacks{
+		OnStartedLeading: func(context.Context) {
+			logger.Info("Became leader, starting to reap", "lease", *leaderElectLeaseName)
+			metricLeader.Set(1)
+			reapLoop()
+		},
+		OnStoppedLeading: func() {
+			metricLeader.Set(0)
+			logger.Error("Lost leadership, exiting", "lease", *leaderElectLeaseName)
+			os.Exit(1)
+		},
+		OnNewLeader: func(identity string) {
+			logger.Info("Leader elected", "leader", identity)
+		},
+	})
+	logger.Info("Waiting to become leader", "lease", *leaderElectLeaseName, "identity", config.Lock.Identity())
+	leaderelection.RunOrDie(context.Background(), config)
+}
+
+// runLocked runs reapOnce while holding the leader election Lease so runs started with run-once, for example by cron,
+// do not overlap with each other or with a long running reaper. It returns the result of reapOnce, 0 without running
+// if the Lease could not be acquired before the lease duration and retry period passed, or 1 if the Lease was lost
+// before reapOnce completed.
+func runLocked(clientset kubernetes.Interface, reapOnce func() int, logger *slog.Logger) int {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var state, errNum atomic.Int32
+	done := make(chan struct{})
+	timer := time.AfterFunc(*leaderElectLeaseDuration+*leaderElectRetryPeriod, func() {
+		if state.CompareAndSwap(lockWaiting, lockTimedOut) {
+			cancel()
+		}
+	})
+	defer timer.Stop()
+	config := leaderElectionConfig(clientset, leaderelection.LeaderCallbacks{
+		OnStartedLeading: func(context.Context) {
+			if !state.CompareAndSwap(lockWaiting, lockHeld) {
+				return
+			}
+			metricLeader.Set(1)
+			errNum.Store(int32(reapOnce()))
+			metricLeader.Set(0)
+			close(done)
+			// Cancelling releases the Lease so the next run does not wait for it to expire
+			cancel()
+		},
+		OnStoppedLeading: func() {},
+	})
+	elector, err := leaderelection.NewLeaderElector(config)
+	if err != nil {
+		logger.Error("Error creating leader elector", "err", err)
+		return 1
+	}
+	elector.Run(ctx)
+	if state.Load() != lockHeld {
+		logger.Warn("Another run holds the lock, not reaping", "lease", *leaderElectLeaseName, "holder", elector.GetLeader())
+		return 0
+	}
+	select {
+	case <-done:
+		return int(errNum.Load())
+	default:
+		logger.Error("Lost the lock before the run completed", "lease", *leaderElectLeaseName)
+		return 1
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRunLocked(t *testing.T) {
+	args := []string{
+		"--leader-elect",
+		"--pod-name=reaper",
+		"--pod-namespace=k8-namespace-reaper",
+		"--leader-elect-lease-duration=300ms",
+		"--leader-elect-renew-deadline=200ms",
+		"--leader-elect-retry-period=50ms",
+	}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	clientset := fake.NewSimpleClientset()
+	runs := 0
+	errNum := runLocked(clientset, func() int {
+		runs++
+		return 1
+	}, logger)
+	if runs != 1 || errNum != 1 {
+		t.Errorf("Unexpected result without lock held, runs: %d errNum: %d", runs, errNum)
+	}
+	lease, err := clientset.CoordinationV1().Leases("k8-namespace-reaper").Get(context.TODO(), appName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error getting lease: %v", err)
+	}
+	if holder := lease.Spec.HolderIdentity; holder != nil && *holder != "" {
+		t.Errorf("Expected lock to be released, held by %s", *holder)
+	}
+
+	holder := "other"
+	leaseDuration := int32(60)
+	clientset = fake.NewSimpleClientset(&coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: appName, Namespace: "k8-namespace-reaper"},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &leaseDuration,
+			AcquireTime:          &metav1.MicroTime{Time: time.Now()},
+			RenewTime:            &metav1.MicroTime{Time: time.Now()},
+		},
+	})
+	runs = 0
+	errNum = runLocked(clientset, func() int {
+		runs++
+		return 0
+	}, logger)
+	if runs != 0 || errNum != 0 {
+		t.Errorf("Unexpected result with lock held by another run, runs: %d errNum: %d", runs, errNum)
+	}
+}
+
+func TestValidateLeaderElection(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		errs int
+	}{
+		{name: "disabled", args: []string{}, errs: 0},
+		{name: "valid", args: []string{"--leader-elect", "--pod-namespace=k8-namespace-reaper"}, errs: 0},
+		{name: "no namespace", args: []string{"--leader-elect"}, errs: 1},
+		{name: "durations", args: []string{"--leader-elect", "--leader-elect-namespace=k8-namespace-reaper", "--leader-elect-lease-duration=10s", "--leader-elect-retry-period=10s"}, errs: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := kingpin.CommandLine.Parse(test.args); err != nil {
+				t.Fatal(err)
+			}
+			if errs := validateLeaderElection(); len(errs) != test.errs {
+				t.Errorf("Unexpected errors, expected %d got: %v", test.errs, errs)
+			}
+		})
+	}
+}
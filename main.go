@@ -15,25 +15,34 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"net/http"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/alecthomas/kingpin/v2"
-	"github.com/prometheus/client_golang/api"
-	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/promslog"
 	"github.com/prometheus/common/version"
+	"github.com/prometheus/prometheus/promql/parser"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
@@ -45,26 +54,122 @@ const (
 	appName          = "k8-namespace-reaper"
 	metricsPath      = "/metrics"
 	metricsNamespace = "k8_namespace_reaper"
+	planPath         = "/plan"
 )
 
 var (
-	namespaceLabels             = kingpin.Flag("namespace-labels", "Labels to use when filtering namespaces").Default("").Envar("NAMESPACE_LABELS").String()
-	namespaceRegexp             = kingpin.Flag("namespace-regexp", "Regular expression of namespaces to reap").Default("").Envar("NAMESPACE_REGEXP").String()
-	namespaceLastUsedAnnotation = kingpin.Flag("namespace-last-used-annotation", "Annotation of when namespace was last used, must be Unix timestamp").Default("").Envar("NAMESPACE_LAST_USED_ANNOTATION").String()
-	prometheusAddress           = kingpin.Flag("prometheus-address", "URL for Prometheus, eg http://prometheus:9090").Envar("PROMETHEUS_ADDRESS").Required().String()
-	prometheusTimeout           = kingpin.Flag("prometheus-timeout", "Duration to timeout Prometheus query").Default("30s").Envar("PROMETHEUS_TIMEOUT").Duration()
-	prometheusRetryTimeout      = kingpin.Flag("prometheus-retry-timeout", "Duration to timeout when retrying Prometheus query").Default("5m").Envar("PROMETHEUS_RETRY_TIMEOUT").Duration()
-	reapAfter                   = kingpin.Flag("reap-after", "How long to wait before reaping unused namespaces").Default("168h").Envar("REAP_AFTER").Duration()
-	lastUsedThreshold           = kingpin.Flag("last-used-threshold", "How long after last used can a namespace be reaped").Default("4h").Envar("LAST_USED_THRESHOLD").Duration()
-	interval                    = kingpin.Flag("interval", "Duration between reap runs").Default("6h").Envar("INTERLVAL").Duration()
-	listenAddress               = kingpin.Flag("listen-address", "Address to listen for HTTP requests").Default(":8080").Envar("LISTEN_ADDRESS").String()
-	processMetrics              = kingpin.Flag("process-metrics", "Collect metrics about running process such as CPU and memory and Go stats").Default("true").Envar("PROCESS_METRICS").Bool()
-	runOnce                     = kingpin.Flag("run-once", "Set application to run once then exit, ie executed with cron").Default("false").Envar("RUN_ONCE").Bool()
-	kubeconfig                  = kingpin.Flag("kubeconfig", "Path to kubeconfig when running outside Kubernetes cluster").Default("").Envar("KUBECONFIG").String()
-	logLevel                    = kingpin.Flag("log-level", "Log level, One of: [debug, info, warn, error]").Default("info").Envar("LOG_LEVEL").Enum(promslog.LevelFlagOptions...)
-	logFormat                   = kingpin.Flag("log-format", "Log format, One of: [logfmt, json]").Default("logfmt").Envar("LOG_FORMAT").Enum(promslog.FormatFlagOptions...)
-	timeNow                     = time.Now
-	metricBuildInfo             = prometheus.NewGauge(prometheus.GaugeOpts{
+	namespaceLabels              = kingpin.Flag("namespace-labels", "Label selectors to use when filtering namespaces, multiple selectors are separated by semicolon").Default("").Envar("NAMESPACE_LABELS").String()
+	namespaceFields              = kingpin.Flag("namespace-fields", "Field selectors to use when filtering namespaces, multiple selectors are separated by semicolon").Default("").Envar("NAMESPACE_FIELDS").String()
+	namespaceRegexp              = kingpin.Flag("namespace-regexp", "Regular expression of namespaces to reap").Default("").Envar("NAMESPACE_REGEXP").String()
+	namespaceExcludeLabels       = kingpin.Flag("namespace-exclude-labels", "Label selector of namespaces to never reap").Default("").Envar("NAMESPACE_EXCLUDE_LABELS").String()
+	namespaceExcludeRegexp       = kingpin.Flag("namespace-exclude-regexp", "Regular expression of namespaces to never reap").Default("").Envar("NAMESPACE_EXCLUDE_REGEXP").String()
+	namespaceLastUsedAnnotation  = kingpin.Flag("namespace-last-used-annotation", "Comma separated annotations of when namespace was last used, newest value is used").Default("").Envar("NAMESPACE_LAST_USED_ANNOTATION").String()
+	namespaceOptOutAnnotation    = kingpin.Flag("namespace-opt-out-annotation", "Annotation that when set to true prevents a namespace from being reaped").Default("").Envar("NAMESPACE_OPT_OUT_ANNOTATION").String()
+	namespaceReapAfterAnnotation = kingpin.Flag("namespace-reap-after-annotation", "Annotation that overrides reap-after for a namespace, must be a duration").Default("").Envar("NAMESPACE_REAP_AFTER_ANNOTATION").String()
+	namespaceExtendAnnotation    = kingpin.Flag("namespace-extend-until-annotation", "Annotation of time until which a namespace will not be reaped, must be Unix timestamp or RFC3339").Default("").Envar("NAMESPACE_EXTEND_UNTIL_ANNOTATION").String()
+	namespaceOverrideMax         = kingpin.Flag("namespace-override-max", "Maximum duration namespace annotations may extend reaping beyond reap-after, 0 is no limit").Default("0").Envar("NAMESPACE_OVERRIDE_MAX").Duration()
+	activitySources              = kingpin.Flag("activity-source", "Comma separated sources used to determine namespace activity, One of: [prometheus, kubernetes]").Default("prometheus").Envar("ACTIVITY_SOURCE").String()
+	activityMode                 = kingpin.Flag("activity-mode", "How to combine multiple activity sources, any source reporting activity keeps a namespace or all sources with data for a namespace must report activity, One of: [any, all]").Default(activityModeAny).Envar("ACTIVITY_MODE").Enum(activityModeAny, activityModeAll)
+	prometheusAddress            = kingpin.Flag("prometheus-address", "URL for Prometheus, eg http://prometheus:9090, required by prometheus activity source").Default("").Envar("PROMETHEUS_ADDRESS").String()
+	prometheusQueryTemplate      = kingpin.Flag("prometheus-query", "Go template of the Prometheus query that returns last activity time by namespace").Default(defaultPrometheusQuery).Envar("PROMETHEUS_QUERY").String()
+	prometheusQueryStep          = kingpin.Flag("prometheus-query-step", "Resolution of the Prometheus activity subquery").Default("5m").Envar("PROMETHEUS_QUERY_STEP").Duration()
+	prometheusNamespaceLabel     = kingpin.Flag("prometheus-namespace-label", "Prometheus label holding the namespace name").Default("namespace").Envar("PROMETHEUS_NAMESPACE_LABEL").String()
+	prometheusBearerToken        = kingpin.Flag("prometheus-bearer-token", "Bearer token used to authenticate to Prometheus").Default("").Envar("PROMETHEUS_BEARER_TOKEN").String()
+	prometheusBearerTokenFile    = kingpin.Flag("prometheus-bearer-token-file", "File containing bearer token used to authenticate to Prometheus").Default("").Envar("PROMETHEUS_BEARER_TOKEN_FILE").String()
+	prometheusInClusterToken     = kingpin.Flag("prometheus-in-cluster-token", "Authenticate to Prometheus using the in cluster service account token").Default("false").Envar("PROMETHEUS_IN_CLUSTER_TOKEN").Bool()
+	prometheusUsername           = kingpin.Flag("prometheus-username", "Basic auth username used to authenticate to Prometheus").Default("").Envar("PROMETHEUS_USERNAME").String()
+	prometheusPassword           = kingpin.Flag("prometheus-password", "Basic auth password used to authenticate to Prometheus").Default("").Envar("PROMETHEUS_PASSWORD").String()
+	prometheusPasswordFile       = kingpin.Flag("prometheus-password-file", "File containing basic auth password used to authenticate to Prometheus").Default("").Envar("PROMETHEUS_PASSWORD_FILE").String()
+	prometheusCAFile             = kingpin.Flag("prometheus-ca-file", "CA bundle used to verify Prometheus certificate").Default("").Envar("PROMETHEUS_CA_FILE").String()
+	prometheusCertFile           = kingpin.Flag("prometheus-cert-file", "Client certificate used to authenticate to Prometheus").Default("").Envar("PROMETHEUS_CERT_FILE").String()
+	prometheusKeyFile            = kingpin.Flag("prometheus-key-file", "Client key used to authenticate to Prometheus").Default("").Envar("PROMETHEUS_KEY_FILE").String()
+	prometheusServerName         = kingpin.Flag("prometheus-server-name", "Server name used to verify Prometheus certificate").Default("").Envar("PROMETHEUS_SERVER_NAME").String()
+	prometheusHeaders            = kingpin.Flag("prometheus-header", "Custom header to send to Prometheus, eg X-Scope-OrgID=tenant, may be repeated").Envar("PROMETHEUS_HEADER").StringMap()
+	prometheusSanityQuery        = kingpin.Flag("prometheus-sanity-query", "Prometheus query that must return data before reaping, set empty to disable").Default(defaultPrometheusSanityQuery).Envar("PROMETHEUS_SANITY_QUERY").String()
+	prometheusTimeout            = kingpin.Flag("prometheus-timeout", "Duration to timeout Prometheus query").Default("30s").Envar("PROMETHEUS_TIMEOUT").Duration()
+	prometheusRetryTimeout       = kingpin.Flag("prometheus-retry-timeout", "Duration to timeout when retrying Prometheus query").Default("5m").Envar("PROMETHEUS_RETRY_TIMEOUT").Duration()
+	prometheusRetryBackoff       = kingpin.Flag("prometheus-retry-backoff", "Initial backoff between Prometheus query retries, doubled each retry").Default("1s").Envar("PROMETHEUS_RETRY_BACKOFF").Duration()
+	prometheusRetryMaxBackoff    = kingpin.Flag("prometheus-retry-max-backoff", "Maximum backoff between Prometheus query retries").Default("30s").Envar("PROMETHEUS_RETRY_MAX_BACKOFF").Duration()
+	reapAfter                    = kingpin.Flag("reap-after", "How long to wait before reaping unused namespaces").Default("168h").Envar("REAP_AFTER").Duration()
+	idleThreshold                = kingpin.Flag("idle-threshold", "How long since last activity before a namespace is idle, defaults to reap-after").Default("0").Envar("IDLE_THRESHOLD").Duration()
+	lastUsedThreshold            = kingpin.Flag("last-used-threshold", "How long after last used can a namespace be reaped").Default("4h").Envar("LAST_USED_THRESHOLD").Duration()
+	interval                     = kingpin.Flag("interval", "Duration between reap runs").Default("6h").Envar("INTERLVAL").Duration()
+	listenAddress                = kingpin.Flag("listen-address", "Address to listen for HTTP requests").Default(":8080").Envar("LISTEN_ADDRESS").String()
+	processMetrics               = kingpin.Flag("process-metrics", "Collect metrics about running process such as CPU and memory and Go stats").Default("true").Envar("PROCESS_METRICS").Bool()
+	runOnce                      = kingpin.Flag("run-once", "Set application to run once then exit, ie executed with cron").Default("false").Envar("RUN_ONCE").Bool()
+	allowEmptyActivity           = kingpin.Flag("allow-empty-activity", "Allow reaping when the activity source returns no activity for any candidate namespace").Default("false").Envar("ALLOW_EMPTY_ACTIVITY").Bool()
+	maxReapPercent               = kingpin.Flag("max-reap-percent", "Abort reaping if more than this percent of candidate namespaces are idle").Default("100").Envar("MAX_REAP_PERCENT").Float64()
+	maxDeletionsPerRun           = kingpin.Flag("max-deletions-per-run", "Maximum number of namespaces to delete each run, longest idle first, 0 is unlimited").Default("0").Envar("MAX_DELETIONS_PER_RUN").Int()
+	paceDeletions                = kingpin.Flag("pace-deletions", "Spread deletions evenly across the interval rather than deleting all at once").Default("false").Envar("PACE_DELETIONS").Bool()
+	deleteConcurrency            = kingpin.Flag("delete-concurrency", "Number of namespaces to delete concurrently").Default("1").Envar("DELETE_CONCURRENCY").Int()
+	deleteTimeout                = kingpin.Flag("delete-timeout", "Timeout for deleting or quarantining each namespace").Default("30s").Envar("DELETE_TIMEOUT").Duration()
+	reapAction                   = kingpin.Flag("reap-action", "What to do with idle namespaces, one of delete or quarantine").Default(reapActionDelete).Envar("REAP_ACTION").Enum(reapActionDelete, reapActionQuarantine)
+	releaseProtection            = kingpin.Flag("release-protection", "How long a namespace released from quarantine is not reaped again, 0 does not protect released namespaces").Default("168h").Envar("RELEASE_PROTECTION").Duration()
+	gracePeriod                  = kingpin.Flag("grace-period", "Schedule idle namespaces for deletion and only delete them if still idle after this duration, 0 deletes immediately").Default("0").Envar("GRACE_PERIOD").Duration()
+	scheduledAnnotation          = kingpin.Flag("scheduled-annotation", "Annotation used to mark when a namespace is scheduled for deletion").Default("k8-namespace-reaper.osc.edu/scheduled-deletion").Envar("SCHEDULED_ANNOTATION").String()
+	webhookURL                   = kingpin.Flag("webhook-url", "URL to POST notifications about reap decisions to").Default("").Envar("WEBHOOK_URL").String()
+	webhookBodyTemplate          = kingpin.Flag("webhook-template", "Go template for webhook request body, defaults to the notification as JSON").Default("").Envar("WEBHOOK_TEMPLATE").String()
+	webhookHeaders               = kingpin.Flag("webhook-header", "Custom header to send with webhook requests, eg Authorization=Bearer token, may be repeated").Envar("WEBHOOK_HEADER").StringMap()
+	webhookEvents                = kingpin.Flag("webhook-events", "Comma separated list of events to send webhook notifications for, one of warned, reaped or failed").Default("warned,reaped,failed").Envar("WEBHOOK_EVENTS").String()
+	webhookTimeout               = kingpin.Flag("webhook-timeout", "Timeout for each webhook request").Default("10s").Envar("WEBHOOK_TIMEOUT").Duration()
+	webhookRetryTimeout          = kingpin.Flag("webhook-retry-timeout", "Duration to timeout when retrying webhook notifications").Default("5m").Envar("WEBHOOK_RETRY_TIMEOUT").Duration()
+	smtpAddress                  = kingpin.Flag("smtp-address", "SMTP server host:port used to email namespace owners").Default("").Envar("SMTP_ADDRESS").String()
+	smtpTLS                      = kingpin.Flag("smtp-tls", "SMTP encryption, one of starttls, tls or none").Default("starttls").Envar("SMTP_TLS").Enum(smtpTLSStartTLS, smtpTLSTLS, smtpTLSNone)
+	smtpCAFile                   = kingpin.Flag("smtp-ca-file", "CA file used to verify the SMTP server certificate").Default("").Envar("SMTP_CA_FILE").String()
+	smtpUsername                 = kingpin.Flag("smtp-username", "Username used to authenticate to the SMTP server").Default("").Envar("SMTP_USERNAME").String()
+	smtpPassword                 = kingpin.Flag("smtp-password", "Password used to authenticate to the SMTP server").Default("").Envar("SMTP_PASSWORD").String()
+	smtpPasswordFile             = kingpin.Flag("smtp-password-file", "File containing password used to authenticate to the SMTP server").Default("").Envar("SMTP_PASSWORD_FILE").String()
+	smtpTimeout                  = kingpin.Flag("smtp-timeout", "Timeout for sending each email").Default("30s").Envar("SMTP_TIMEOUT").Duration()
+	emailFrom                    = kingpin.Flag("email-from", "Address emails to namespace owners are sent from").Default("").Envar("EMAIL_FROM").String()
+	emailOwnerAnnotation         = kingpin.Flag("email-owner-annotation", "Annotation containing the owner of a namespace").Default("").Envar("EMAIL_OWNER_ANNOTATION").String()
+	emailOwnerRegexp             = kingpin.Flag("email-owner-regexp", "Regular expression whose first capture group is the owner of a namespace, eg ^user-(.+)$").Default("").Envar("EMAIL_OWNER_REGEXP").String()
+	emailDomain                  = kingpin.Flag("email-domain", "Domain appended to owners that are not email addresses").Default("").Envar("EMAIL_DOMAIN").String()
+	emailEvents                  = kingpin.Flag("email-events", "Comma separated list of events to email namespace owners for, one of warned, reaped or failed").Default("warned,reaped").Envar("EMAIL_EVENTS").String()
+	emailSubjectTemplate         = kingpin.Flag("email-subject-template", "Go template for email subject").Default(defaultEmailSubjectTemplate).Envar("EMAIL_SUBJECT_TEMPLATE").String()
+	emailBodyTemplate            = kingpin.Flag("email-body-template", "Go template for email body").Default(defaultEmailBodyTemplate).Envar("EMAIL_BODY_TEMPLATE").String()
+	archiveDir                   = kingpin.Flag("archive-dir", "Directory to archive namespace resources to before deleting namespaces").Default("").Envar("ARCHIVE_DIR").String()
+	archiveRetention             = kingpin.Flag("archive-retention", "How long to keep namespace archives, 0 keeps archives forever").Default("0").Envar("ARCHIVE_RETENTION").Duration()
+	archiveTimeout               = kingpin.Flag("archive-timeout", "Timeout for archiving each namespace, 0 is no timeout").Default("10m").Envar("ARCHIVE_TIMEOUT").Duration()
+	archiveSkipKinds             = kingpin.Flag("archive-skip-kinds", "Comma separated list of kinds not to archive, either Kind or Kind.group").Default("Event,Endpoints,EndpointSlice,PodMetrics").Envar("ARCHIVE_SKIP_KINDS").String()
+	terminatingCheckInterval     = kingpin.Flag("terminating-check-interval", "How often to check on namespaces the reaper deleted that are still terminating").Default("1m").Envar("TERMINATING_CHECK_INTERVAL").Duration()
+	terminatingStuckAfter        = kingpin.Flag("terminating-stuck-after", "How long a deleted namespace may be terminating before it is reported as stuck").Default("1h").Envar("TERMINATING_STUCK_AFTER").Duration()
+	finalizerRemovalTimeout      = kingpin.Flag("finalizer-removal-timeout", "How long a deleted namespace may be terminating before allowed finalizers are removed, 0 never removes finalizers").Default("0").Envar("FINALIZER_REMOVAL_TIMEOUT").Duration()
+	finalizerRemovalAllow        = kingpin.Flag("finalizer-removal-allow", "Comma separated list of finalizers that may be removed from stuck namespaces and their resources").Default("").Envar("FINALIZER_REMOVAL_ALLOW").String()
+	auditFile                    = kingpin.Flag("audit-file", "File to append a JSON Lines audit record of each namespace reaped to").Default("").Envar("AUDIT_FILE").String()
+	auditFileMaxSize             = kingpin.Flag("audit-file-max-size", "Size the audit file is rotated at, 0 never rotates").Default("100MB").Envar("AUDIT_FILE_MAX_SIZE").Bytes()
+	auditFileMaxFiles            = kingpin.Flag("audit-file-max-files", "Number of rotated audit files to keep").Default("5").Envar("AUDIT_FILE_MAX_FILES").Int()
+	auditConfigMap               = kingpin.Flag("audit-configmap", "ConfigMap to append audit records of each namespace reaped to").Default("").Envar("AUDIT_CONFIGMAP").String()
+	auditConfigMapNamespace      = kingpin.Flag("audit-configmap-namespace", "Namespace of the audit ConfigMap, defaults to pod-namespace").Default("").Envar("AUDIT_CONFIGMAP_NAMESPACE").String()
+	auditConfigMapMaxRecords     = kingpin.Flag("audit-configmap-max-records", "Number of newest audit records to keep in the audit ConfigMap").Default("1000").Envar("AUDIT_CONFIGMAP_MAX_RECORDS").Int()
+	leaderElect                  = kingpin.Flag("leader-elect", "Elect a leader with a Lease so only one replica reaps, with run-once the Lease is a lock that stops overlapping runs").Default("false").Envar("LEADER_ELECT").Bool()
+	leaderElectLeaseName         = kingpin.Flag("leader-elect-lease-name", "Name of the Lease used for leader election").Default(appName).Envar("LEADER_ELECT_LEASE_NAME").String()
+	leaderElectNamespace         = kingpin.Flag("leader-elect-namespace", "Namespace of the Lease used for leader election, defaults to pod-namespace").Default("").Envar("LEADER_ELECT_NAMESPACE").String()
+	leaderElectLeaseDuration     = kingpin.Flag("leader-elect-lease-duration", "How long replicas wait before taking over leadership from a leader that stopped renewing").Default("15s").Envar("LEADER_ELECT_LEASE_DURATION").Duration()
+	leaderElectRenewDeadline     = kingpin.Flag("leader-elect-renew-deadline", "How long the leader retries renewing leadership before giving it up").Default("10s").Envar("LEADER_ELECT_RENEW_DEADLINE").Duration()
+	leaderElectRetryPeriod       = kingpin.Flag("leader-elect-retry-period", "How long replicas wait between attempts to acquire or renew leadership").Default("2s").Envar("LEADER_ELECT_RETRY_PERIOD").Duration()
+	dryRun                       = kingpin.Flag("dry-run", "Report which namespaces would be reaped without deleting them").Default("false").Envar("DRY_RUN").Bool()
+	podName                      = kingpin.Flag("pod-name", "Name of the reaper's Pod, events about reap runs are recorded on this Pod").Default("").Envar("POD_NAME").String()
+	podNamespace                 = kingpin.Flag("pod-namespace", "Namespace of the reaper's Pod").Default("").Envar("POD_NAMESPACE").String()
+	podUID                       = kingpin.Flag("pod-uid", "UID of the reaper's Pod").Default("").Envar("POD_UID").String()
+	kubeconfig                   = kingpin.Flag("kubeconfig", "Path to kubeconfig when running outside Kubernetes cluster").Default("").Envar("KUBECONFIG").String()
+	logLevel                     = kingpin.Flag("log-level", "Log level, One of: [debug, info, warn, error]").Default("info").Envar("LOG_LEVEL").Enum(promslog.LevelFlagOptions...)
+	logFormat                    = kingpin.Flag("log-format", "Log format, One of: [logfmt, json]").Default("logfmt").Envar("LOG_FORMAT").Enum(promslog.FormatFlagOptions...)
+	reapCommand                  = kingpin.Command("reap", "Reap unused namespaces").Default()
+	restoreCommand               = kingpin.Command("restore", "Restore a reaped namespace from an archive")
+	restoreArchive               = restoreCommand.Arg("archive", "Path to namespace archive created with --archive-dir").Required().ExistingFile()
+	restoreNamespace             = restoreCommand.Flag("namespace", "Restore into this namespace instead of the archived namespace").Default("").String()
+	restoreConflict              = restoreCommand.Flag("conflict", "How to handle resources that already exist, one of skip, overwrite or fail").Default(restoreConflictSkip).Enum(restoreConflictSkip, restoreConflictOverwrite, restoreConflictFail)
+	releaseCommand               = kingpin.Command("release", "Release a quarantined namespace, undoing the changes made by quarantine")
+	releaseNamespace             = releaseCommand.Arg("namespace", "Namespace to release").Required().String()
+	historyCommand               = kingpin.Command("history", "Show the audit history of reaped namespaces from --audit-file or --audit-configmap")
+	historyNamespace             = historyCommand.Arg("namespace", "Only show records of this namespace").Default("").String()
+	historySince                 = historyCommand.Flag("since", "Only show records newer than this duration").Default("0").Duration()
+	historyResult                = historyCommand.Flag("result", "Only show records with this result, one of reaped, skipped or failed").Default("").Enum("", auditResultReaped, auditResultSkipped, auditResultFailed)
+	historyOutput                = historyCommand.Flag("output", "Output format, one of table or json").Short('o').Default(historyOutputTable).Enum(historyOutputTable, historyOutputJSON)
+	timeNow                      = time.Now
+	sleep                        = time.Sleep
+	lastPlan                     = &planStore{}
+	metricBuildInfo              = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: metricsNamespace,
 		Name:      "build_info",
 		Help:      "Build information",
@@ -76,6 +181,11 @@ var (
 			"goversion": version.GoVersion,
 		},
 	})
+	metricScheduledTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "scheduled_total",
+		Help:      "Total number of namespaces scheduled for deletion",
+	})
 	metricReapedTotal = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: metricsNamespace,
 		Name:      "reaped_total",
@@ -91,13 +201,200 @@ var (
 		Name:      "errors_total",
 		Help:      "Total number of errors",
 	})
+	metricSafetyAbortsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "safety_aborts_total",
+		Help:      "Total number of reap runs aborted by a safety check",
+	}, []string{"reason"})
+	metricPrometheusQueryAttemptsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "prometheus_query_attempts_total",
+		Help:      "Total number of Prometheus query attempts by result",
+	}, []string{"result"})
+	metricPrometheusQueryDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "prometheus_query_duration_seconds",
+		Help:      "Duration of Prometheus query attempts",
+		Buckets:   prometheus.DefBuckets,
+	})
+	metricPrometheusQueriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "prometheus_queries_total",
+		Help:      "Total number of Prometheus queries by final outcome after retries",
+	}, []string{"outcome"})
+	metricNotificationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "notifications_total",
+		Help:      "Total number of notifications sent by notifier and result",
+	}, []string{"notifier", "result"})
+	metricArchivesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "archives_total",
+		Help:      "Total number of namespace archives by result",
+	}, []string{"result"})
+	metricArchiveDiscoveryFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "archive_discovery_failures_total",
+		Help:      "Total number of times an API group could not be discovered and was not archived",
+	}, []string{"group"})
+	metricAuditRecordsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "audit_records_total",
+		Help:      "Total number of audit records written by sink and result",
+	}, []string{"sink", "result"})
+	metricLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "leader",
+		Help:      "Indicates this replica is the leader that reaps namespaces",
+	})
 	metricDuration = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: metricsNamespace,
 		Name:      "run_duration_seconds",
 		Help:      "Last runtime duration in seconds",
 	})
+	metricIdle = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "namespace_idle_seconds",
+		Help:      "Time since last activity of namespaces considered for reaping",
+	}, []string{"namespace"})
+	metricDryRun = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "dry_run",
+		Help:      "Indicates if the reaper is running in dry run mode",
+	})
+	metricSkippedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "skipped_total",
+		Help:      "Total number of namespaces not reaped because they changed after being evaluated",
+	})
+	metricHeldBack = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "held_back",
+		Help:      "Namespaces held back during last run by the maximum deletions per run",
+	}, []string{"namespace"})
+	metricTerminationDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "termination_duration_seconds",
+		Help:      "Time from deleting a namespace until it finished terminating",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 9),
+	})
+	metricTerminating = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "terminating",
+		Help:      "Number of namespaces deleted by the reaper that are still terminating",
+	})
+	metricStuckTerminating = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "stuck_terminating",
+		Help:      "Number of namespaces deleted by the reaper that have been terminating longer than terminating-stuck-after",
+	})
+	metricTerminationBlocked = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "termination_blocked",
+		Help:      "Conditions blocking stuck namespaces from terminating",
+	}, []string{"namespace", "condition"})
+	metricFinalizersRemovedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "finalizers_removed_total",
+		Help:      "Total number of finalizers removed from stuck namespaces and their resources",
+	}, []string{"finalizer"})
+	metricWouldReap = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "would_reap",
+		Help:      "Namespaces that would have been reaped during last dry run",
+	}, []string{"namespace"})
+)
+
+// namespaceCandidate is a namespace that passed filtering and will be reaped if not active
+type namespaceCandidate struct {
+	Name            string
+	UID             types.UID
+	ResourceVersion string
+	Labels          map[string]string
+	Annotations     map[string]string
+	Created         time.Time
+	Age             time.Duration
+	ReapAfter       time.Duration
+	LastUsed        *time.Duration
+	LastActivity    *time.Time
+}
+
+const (
+	reapActionDelete     = "delete"
+	reapActionQuarantine = "quarantine"
+)
+
+const (
+	actionReap     = "reap"
+	actionSchedule = "schedule"
+	actionWait     = "wait"
+	actionHold     = "hold"
+	actionSkip     = "skip"
+)
+
+type deleteResult int
+
+const (
+	deleteReaped deleteResult = iota
+	deleteSkipped
+	deleteFailed
 )
 
+// deletion is a namespace to delete and the index of its entry in the plan
+type deletion struct {
+	index     int
+	namespace namespaceCandidate
+	logger    *slog.Logger
+}
+
+// planEntry describes a namespace selected for reaping and why
+type planEntry struct {
+	Namespace         string     `json:"namespace"`
+	Action            string     `json:"action"`
+	Reason            string     `json:"reason"`
+	LastActivity      *time.Time `json:"lastActivity,omitempty"`
+	ScheduledDeletion *time.Time `json:"scheduledDeletion,omitempty"`
+	Archive           string     `json:"archive,omitempty"`
+	Skipped           string     `json:"skipped,omitempty"`
+	Reaped            bool       `json:"reaped"`
+}
+
+// plan is the outcome of the last reap run
+type plan struct {
+	DryRun     bool        `json:"dryRun"`
+	ReapAction string      `json:"reapAction"`
+	Time       time.Time   `json:"time"`
+	Namespaces []planEntry `json:"namespaces"`
+}
+
+// count returns the number of namespaces planned with an action
+func (p plan) count(action string) int {
+	n := 0
+	for _, entry := range p.Namespaces {
+		if entry.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+type planStore struct {
+	mu   sync.RWMutex
+	plan plan
+}
+
+func (s *planStore) set(p plan) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.plan = p
+}
+
+func (s *planStore) get() plan {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.plan
+}
+
 func init() {
 	metricBuildInfo.Set(1)
 }
@@ -105,15 +402,25 @@ func init() {
 func main() {
 	kingpin.Version(version.Print(appName))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	command := kingpin.Parse()
 
 	logger := setupLogging()
 	if logger == nil {
 		os.Exit(1)
 	}
 
-	if err := validateArgs(logger); err != nil {
-		os.Exit(1)
+	if command == reapCommand.FullCommand() {
+		if err := validateArgs(logger); err != nil {
+			os.Exit(1)
+		}
+	}
+	if command == historyCommand.FullCommand() && *auditConfigMap == "" {
+		// Reading the audit file does not need access to Kubernetes
+		if err := history(nil, os.Stdout, logger); err != nil {
+			logger.Error("Error showing history", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
 	var config *rest.Config
@@ -135,9 +442,41 @@ func main() {
 		logger.Error("Unable to generate Clientset", "err", err)
 		os.Exit(1)
 	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		logger.Error("Unable to generate dynamic client", "err", err)
+		os.Exit(1)
+	}
+
+	if command == releaseCommand.FullCommand() {
+		eventRecorder = newSyncEventRecorder(clientset, logger)
+		if err := release(clientset, logger); err != nil {
+			logger.Error("Error releasing namespace", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if command == historyCommand.FullCommand() {
+		if err := history(clientset, os.Stdout, logger); err != nil {
+			logger.Error("Error showing history", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if command == restoreCommand.FullCommand() {
+		if err := restore(clientset, dynamicClient, logger); err != nil {
+			logger.Error("Error restoring namespace", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
 	logger.Info(fmt.Sprintf("Starting %s", appName), "version", version.Info())
 	logger.Info("Build context", "build_context", version.BuildContext())
+	if *dryRun {
+		logger.Info("Running in dry run mode, no namespaces will be deleted")
+		metricDryRun.Set(1)
+	}
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
@@ -145,10 +484,12 @@ func main() {
 	             <body>
 	             <h1>` + appName + `</h1>
 	             <p><a href='` + metricsPath + `'>Metrics</a></p>
+	             <p><a href='` + planPath + `'>Reap Plan</a></p>
 	             </body>
 	             </html>`))
 	})
 	http.Handle(metricsPath, promhttp.HandlerFor(metricGathers(), promhttp.HandlerOpts{}))
+	http.HandleFunc(planPath, planHandler)
 
 	go func() {
 		if err := http.ListenAndServe(*listenAddress, nil); err != nil {
@@ -157,24 +498,62 @@ func main() {
 		}
 	}()
 
-	for {
-		var errNum int
-		start := timeNow()
-		err = run(clientset, logger)
-		metricDuration.Set(time.Since(start).Seconds())
-		if err != nil {
-			errNum = 1
+	if *runOnce {
+		// The process exits once the run completes so events are written before the run continues
+		eventRecorder = newSyncEventRecorder(clientset, logger)
+		reapOnce := func() int {
+			return timedRun(clientset, dynamicClient, logger)
 		}
-		metricError.Set(float64(errNum))
-		if *runOnce {
-			os.Exit(errNum)
+		var errNum int
+		if *leaderElect {
+			errNum = runLocked(clientset, reapOnce, logger)
 		} else {
-			logger.Debug("Sleeping for interval", "interval", fmt.Sprintf("%.0f", (*interval).Seconds()))
-			time.Sleep(*interval)
+			errNum = reapOnce()
 		}
+		notifications.Wait()
+		os.Exit(errNum)
+	}
+
+	eventRecorder = newEventRecorder(clientset)
+
+	reapLoop := func() {
+		if !*dryRun {
+			go watchTerminating(clientset, dynamicClient, logger)
+		}
+		for {
+			start := timeNow()
+			timedRun(clientset, dynamicClient, logger)
+			wait := *interval
+			if *paceDeletions {
+				// Paced deletions already take up part of the interval
+				wait -= time.Since(start)
+			}
+			logger.Debug("Sleeping for interval", "interval", fmt.Sprintf("%.0f", wait.Seconds()))
+			time.Sleep(wait)
+		}
+	}
+	if *leaderElect {
+		runAsLeader(clientset, reapLoop, logger)
+	} else {
+		metricLeader.Set(1)
+		reapLoop()
 	}
 }
 
+// timedRun runs the reaper once and records the outcome, returning 1 if there was an error
+func timedRun(clientset kubernetes.Interface, dynamicClient dynamic.Interface, logger *slog.Logger) int {
+	var errNum int
+	start := timeNow()
+	err := run(clientset, dynamicClient, logger)
+	metricDuration.Set(time.Since(start).Seconds())
+	if err != nil {
+		errNum = 1
+	}
+	metricError.Set(float64(errNum))
+	runEvent(err)
+	return errNum
+}
+
 func setupLogging() *slog.Logger {
 	level := promslog.NewLevel()
 	_ = level.Set(*logLevel)
@@ -190,8 +569,53 @@ func setupLogging() *slog.Logger {
 
 func validateArgs(logger *slog.Logger) []error {
 	var errs []error
-	if *namespaceLabels == "" && *namespaceRegexp == "" {
-		errs = append(errs, errors.New("must provide either namespaces labels or namespace regexp"))
+	if *namespaceLabels == "" && *namespaceFields == "" && *namespaceRegexp == "" {
+		errs = append(errs, errors.New("must provide either namespaces labels, namespace fields or namespace regexp"))
+	}
+	if _, err := namespaceListOptions(); err != nil {
+		errs = append(errs, err)
+	}
+	if *deleteConcurrency < 1 {
+		errs = append(errs, errors.New("delete concurrency must be at least 1"))
+	}
+	if *maxReapPercent < 0 || *maxReapPercent > 100 {
+		errs = append(errs, errors.New("max reap percent must be between 0 and 100"))
+	}
+	if *idleThreshold > *reapAfter {
+		errs = append(errs, errors.New("idle threshold must not be longer than reap after as activity is only checked within reap after"))
+	}
+	for _, source := range strings.Split(*activitySources, ",") {
+		switch strings.TrimSpace(source) {
+		case "prometheus":
+			if *prometheusAddress == "" {
+				errs = append(errs, errors.New("must provide prometheus address when using prometheus activity source"))
+			}
+			if _, err := prometheusQuery(); err != nil {
+				errs = append(errs, err)
+			}
+			if *prometheusSanityQuery != "" {
+				if _, err := parser.ParseExpr(*prometheusSanityQuery); err != nil {
+					errs = append(errs, fmt.Errorf("invalid prometheus sanity query: %w", err))
+				}
+			}
+			if _, err := prometheusHTTPConfig(); err != nil {
+				errs = append(errs, err)
+			}
+		case "kubernetes":
+		default:
+			errs = append(errs, fmt.Errorf("unknown activity source %q", source))
+		}
+	}
+	errs = append(errs, validateWebhook()...)
+	errs = append(errs, validateEmail()...)
+	errs = append(errs, validateTerminating()...)
+	errs = append(errs, validateAudit()...)
+	errs = append(errs, validateLeaderElection()...)
+	if _, err := regexp.Compile(*namespaceExcludeRegexp); err != nil {
+		errs = append(errs, fmt.Errorf("invalid namespace exclude regexp: %w", err))
+	}
+	if _, err := labels.Parse(*namespaceExcludeLabels); err != nil {
+		errs = append(errs, fmt.Errorf("invalid namespace exclude labels: %w", err))
 	}
 	for _, err := range errs {
 		logger.Error(err.Error())
@@ -199,18 +623,47 @@ func validateArgs(logger *slog.Logger) []error {
 	return errs
 }
 
-func run(clientset kubernetes.Interface, logger *slog.Logger) error {
+func run(clientset kubernetes.Interface, dynamicClient dynamic.Interface, logger *slog.Logger) error {
+	skippedEvents.startRun()
 	namespaces, err := getNamespaces(clientset, logger)
 	if err != nil {
 		logger.Error("Error getting namespaces", "err", err)
 		return err
 	}
-	activeNamespaces, err := getActiveNamespaces(logger)
+	activitySource, err := getActivitySource(clientset, logger)
 	if err != nil {
-		logger.Error("Error getting active namespaces", "err", err)
+		logger.Error("Error creating activity source", "err", err)
 		return err
 	}
-	errCount := reap(namespaces, activeNamespaces, clientset, logger)
+	activity, err := activitySource.LastActivity(context.Background(), candidateNames(namespaces))
+	if err != nil {
+		logger.Error("Error getting active namespaces", "source", activitySource.Name(), "err", err)
+		return err
+	}
+	// Activity only for namespaces that are not candidates, such as system namespaces, is still treated as empty
+	if candidateActivity(namespaces, activity) == 0 && len(namespaces) > 0 && !*allowEmptyActivity {
+		err := fmt.Errorf("activity source %s returned no activity for %d candidate namespaces", activitySource.Name(), len(namespaces))
+		logger.Error("Aborting reap", "err", err)
+		metricSafetyAbortsTotal.WithLabelValues("empty_activity").Inc()
+		return err
+	}
+	idle := idleNamespaces(namespaces, activity, logger)
+	if len(namespaces) > 0 {
+		percent := float64(len(idle)) / float64(len(namespaces)) * 100
+		if percent > *maxReapPercent {
+			err := fmt.Errorf("%.1f%% of candidate namespaces are idle which exceeds max reap percent %.1f%%", percent, *maxReapPercent)
+			logger.Error("Aborting reap", "err", err, "idle", len(idle), "candidates", len(namespaces))
+			metricSafetyAbortsTotal.WithLabelValues("max_reap_percent").Inc()
+			return err
+		}
+	}
+	errCount := reap(idle, clientset, dynamicClient, getNamespaceAction(), getNotifiers(logger), getAuditSinks(clientset), logger)
+	if *gracePeriod > 0 {
+		errCount += clearScheduled(clientset, idle, logger)
+	}
+	if !*dryRun {
+		errCount += pruneArchives(logger)
+	}
 	if errCount > 0 {
 		err := fmt.Errorf("%d errors encountered during reap", errCount)
 		logger.Error(err.Error())
@@ -219,147 +672,612 @@ func run(clientset kubernetes.Interface, logger *slog.Logger) error {
 	return nil
 }
 
-func getNamespaces(clientset kubernetes.Interface, logger *slog.Logger) ([]string, error) {
-	var namespaces []string
+func getNamespaces(clientset kubernetes.Interface, logger *slog.Logger) ([]namespaceCandidate, error) {
+	var namespaces []namespaceCandidate
 	namespacePattern := regexp.MustCompile(*namespaceRegexp)
-	nsLabels := strings.Split(*namespaceLabels, ",")
-	if len(nsLabels) == 0 {
-		nsLabels = []string{"all"}
+	excludePattern := regexp.MustCompile(*namespaceExcludeRegexp)
+	excludeSelector, err := labels.Parse(*namespaceExcludeLabels)
+	if err != nil {
+		logger.Error("Error parsing namespace exclude labels", "err", err)
+		return nil, err
 	}
-	for _, label := range nsLabels {
-		nsListOptions := metav1.ListOptions{}
-		if label != "all" {
-			nsListOptions.LabelSelector = label
-		}
-		logger.Debug("Getting namespaces with label", "label", label)
+	listOptions, err := namespaceListOptions()
+	if err != nil {
+		logger.Error("Error parsing namespace selectors", "err", err)
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, nsListOptions := range listOptions {
+		logger.Debug("Getting namespaces with selectors", "label", nsListOptions.LabelSelector, "field", nsListOptions.FieldSelector)
 		ns, err := clientset.CoreV1().Namespaces().List(context.TODO(), nsListOptions)
 		if err != nil {
-			logger.Error("Error getting namespace list", "label", label, "err", err)
+			logger.Error("Error getting namespace list", "label", nsListOptions.LabelSelector, "field", nsListOptions.FieldSelector, "err", err)
 			return nil, err
 		}
 		logger.Debug("Namespaces returned", "count", len(ns.Items))
 		for _, namespace := range ns.Items {
+			if seen[namespace.Name] {
+				logger.Debug("Skipping namespace already matched by another selector", "namespace", namespace.Name)
+				continue
+			}
+			seen[namespace.Name] = true
 			if *namespaceRegexp != "" && !namespacePattern.MatchString(namespace.Name) {
 				logger.Debug("Skipping namespace that does not match namespace regexp", "namespace", namespace.Name)
 				continue
 			}
-			currentAge := timeNow().Sub(namespace.CreationTimestamp.Time)
-			if currentAge < *reapAfter {
-				logger.Debug("Skipping namespace due to age", "namespace", namespace.Name, "age", currentAge.String())
+			if *namespaceExcludeRegexp != "" && excludePattern.MatchString(namespace.Name) {
+				logger.Debug("Skipping namespace that matches namespace exclude regexp", "namespace", namespace.Name)
 				continue
 			}
-			if *namespaceLastUsedAnnotation != "" {
-				if val, ok := namespace.Annotations[*namespaceLastUsedAnnotation]; ok {
-					sec, err := strconv.ParseInt(val, 10, 64)
-					if err != nil {
-						logger.Error("Unable to parse namespace last used annotation", "namespace", namespace.Name, "err", err)
-						continue
-					}
-					timeSinceLastUsed := timeNow().Sub(time.Unix(sec, 0))
-					if timeSinceLastUsed < *lastUsedThreshold {
-						logger.Debug("Skipping namespace due to recently used", "namespace", namespace.Name, "last-used", timeSinceLastUsed.String())
-						continue
-					}
-				} else {
-					logger.Debug("Namespace lacks last used annotation", "namespace", namespace.Name)
-				}
+			candidate, ok := evaluateNamespace(namespace, excludeSelector, logger)
+			if !ok {
+				continue
 			}
-			namespaces = append(namespaces, namespace.Name)
+			namespaces = append(namespaces, candidate)
 		}
 	}
 	return namespaces, nil
 }
 
-func getActiveNamespaces(logger *slog.Logger) ([]string, error) {
-	var namespaces []string
-	client, err := api.NewClient(api.Config{
-		Address: *prometheusAddress,
+// evaluateNamespace checks the labels, annotations and age of a namespace and returns it as a candidate if it may be reaped
+func evaluateNamespace(namespace corev1.Namespace, excludeSelector labels.Selector, logger *slog.Logger) (namespaceCandidate, bool) {
+	if namespace.Labels[quarantineLabel] == "true" {
+		logger.Debug("Skipping namespace that is quarantined", "namespace", namespace.Name)
+		return namespaceCandidate{}, false
+	}
+	if released, ok := recentlyReleased(namespace); ok {
+		logger.Debug("Skipping namespace recently released from quarantine", "namespace", namespace.Name, "released", released.String())
+		return namespaceCandidate{}, false
+	}
+	if *namespaceExcludeLabels != "" && excludeSelector.Matches(labels.Set(namespace.Labels)) {
+		logger.Debug("Skipping namespace that matches namespace exclude labels", "namespace", namespace.Name)
+		return namespaceCandidate{}, false
+	}
+	nsReapAfter, skip := namespaceOverrides(namespace, logger)
+	if skip {
+		return namespaceCandidate{}, false
+	}
+	currentAge := timeNow().Sub(namespace.CreationTimestamp.Time)
+	if currentAge < nsReapAfter {
+		logger.Debug("Skipping namespace due to age", "namespace", namespace.Name, "age", currentAge.String(), "reap-after", nsReapAfter.String())
+		return namespaceCandidate{}, false
+	}
+	candidate := namespaceCandidate{
+		Name:            namespace.Name,
+		UID:             namespace.UID,
+		ResourceVersion: namespace.ResourceVersion,
+		Labels:          namespace.Labels,
+		Annotations:     namespace.Annotations,
+		Created:         namespace.CreationTimestamp.Time,
+		Age:             currentAge,
+		ReapAfter:       nsReapAfter,
+	}
+	if *namespaceLastUsedAnnotation != "" {
+		lastUsed, found, err := namespaceLastUsed(namespace)
+		if err != nil {
+			logger.Error("Unable to parse namespace last used annotation", "namespace", namespace.Name, "err", err)
+			return namespaceCandidate{}, false
+		}
+		if found {
+			timeSinceLastUsed := timeNow().Sub(lastUsed)
+			if timeSinceLastUsed < *lastUsedThreshold {
+				logger.Debug("Skipping namespace due to recently used", "namespace", namespace.Name, "last-used", timeSinceLastUsed.String())
+				skippedEvent(namespace.Name, namespace.UID, "last-used",
+					"Namespace not reaped, last used %s ago is within last-used-threshold %s", timeSinceLastUsed.Round(time.Second).String(), (*lastUsedThreshold).String())
+				return namespaceCandidate{}, false
+			}
+			candidate.LastUsed = &timeSinceLastUsed
+		} else {
+			logger.Debug("Namespace lacks last used annotation", "namespace", namespace.Name)
+		}
+	}
+	return candidate, true
+}
+
+// namespaceListOptions returns the list options needed to find namespaces matching any label
+// selector and any field selector. Each selector is kept whole so commas within a selector are ANDed.
+func namespaceListOptions() ([]metav1.ListOptions, error) {
+	labelSelectors, err := splitSelectors(*namespaceLabels, func(s string) error {
+		_, err := labels.Parse(s)
+		return err
 	})
 	if err != nil {
-		logger.Error("Error creating client", "err", err)
-		return nil, err
+		return nil, fmt.Errorf("invalid namespace labels: %w", err)
+	}
+	fieldSelectors, err := splitSelectors(*namespaceFields, func(s string) error {
+		_, err := fields.ParseSelector(s)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid namespace fields: %w", err)
 	}
+	var listOptions []metav1.ListOptions
+	for _, label := range labelSelectors {
+		for _, field := range fieldSelectors {
+			listOptions = append(listOptions, metav1.ListOptions{LabelSelector: label, FieldSelector: field})
+		}
+	}
+	return listOptions, nil
+}
 
-	v1api := v1.NewAPI(client)
+// splitSelectors splits semicolon separated selectors, an empty value results in a single empty selector
+func splitSelectors(value string, validate func(string) error) ([]string, error) {
+	var selectors []string
+	for _, selector := range strings.Split(value, ";") {
+		selector = strings.TrimSpace(selector)
+		if selector == "" {
+			continue
+		}
+		if err := validate(selector); err != nil {
+			return nil, err
+		}
+		selectors = append(selectors, selector)
+	}
+	if len(selectors) == 0 {
+		selectors = []string{""}
+	}
+	return selectors, nil
+}
 
-	// Retry logic for Prometheus query with timeout
-	startTime := timeNow()
-	timeout := *prometheusRetryTimeout
-	ctx, cancel := context.WithTimeout(context.Background(), *prometheusTimeout)
-	defer cancel()
-	var queryFilter string
-	if *namespaceRegexp != "" {
-		queryFilter = fmt.Sprintf("{namespace=~\"%s\"}", *namespaceRegexp)
-	}
-	query := fmt.Sprintf("max(max_over_time(timestamp(kube_pod_container_info%s)[%s:5m])) by (namespace)",
-		queryFilter, (*reapAfter).String())
-	var result model.Value
-	var warnings v1.Warnings
-	for {
-		result, warnings, err = v1api.Query(ctx, query, time.Now())
+// namespaceOverrides returns the reap-after to use for a namespace and if the namespace
+// should be skipped based on the namespace's own annotations
+func namespaceOverrides(namespace corev1.Namespace, logger *slog.Logger) (time.Duration, bool) {
+	nsReapAfter := *reapAfter
+	if *namespaceReapAfterAnnotation != "" {
+		if val, ok := namespace.Annotations[*namespaceReapAfterAnnotation]; ok {
+			override, err := time.ParseDuration(val)
+			if err != nil {
+				logger.Error("Unable to parse namespace reap after annotation", "namespace", namespace.Name, "err", err)
+			} else {
+				nsReapAfter = override
+			}
+		}
+	}
+	if *namespaceOptOutAnnotation != "" {
+		if val, ok := namespace.Annotations[*namespaceOptOutAnnotation]; ok {
+			optOut, err := strconv.ParseBool(val)
+			if err != nil {
+				logger.Error("Unable to parse namespace opt out annotation", "namespace", namespace.Name, "err", err)
+			} else if optOut && *namespaceOverrideMax == 0 {
+				logger.Debug("Skipping namespace due to opt out annotation", "namespace", namespace.Name)
+				skippedEvent(namespace.Name, namespace.UID, "opt-out", "Namespace not reaped, opted out with annotation %s", *namespaceOptOutAnnotation)
+				return nsReapAfter, true
+			} else if optOut {
+				// With a maximum override an opt out only delays reaping as long as allowed
+				nsReapAfter = *reapAfter + *namespaceOverrideMax
+			}
+		}
+	}
+	if *namespaceOverrideMax != 0 && nsReapAfter > *reapAfter+*namespaceOverrideMax {
+		logger.Debug("Limiting namespace reap after override", "namespace", namespace.Name, "reap-after", nsReapAfter.String(), "max", (*reapAfter + *namespaceOverrideMax).String())
+		nsReapAfter = *reapAfter + *namespaceOverrideMax
+	}
+	if *namespaceExtendAnnotation != "" {
+		if val, ok := namespace.Annotations[*namespaceExtendAnnotation]; ok {
+			extendUntil, err := parseAnnotationTime(val)
+			if err != nil {
+				logger.Error("Unable to parse namespace extend until annotation", "namespace", namespace.Name, "err", err)
+				return nsReapAfter, false
+			}
+			if *namespaceOverrideMax != 0 {
+				// Anchored to the namespace's age so the limit does not move forward with each run
+				maxExtend := namespace.CreationTimestamp.Add(*reapAfter + *namespaceOverrideMax)
+				if extendUntil.After(maxExtend) {
+					logger.Debug("Limiting namespace extend until override", "namespace", namespace.Name, "extend-until", extendUntil.String(), "max", maxExtend.String())
+					extendUntil = maxExtend
+				}
+			}
+			if timeNow().Before(extendUntil) {
+				logger.Debug("Skipping namespace due to extend until annotation", "namespace", namespace.Name, "extend-until", extendUntil.String())
+				skippedEvent(namespace.Name, namespace.UID, "extend-until "+extendUntil.UTC().Format(time.RFC3339), "Namespace not reaped, extended until %s", extendUntil.UTC().Format(time.RFC3339))
+				return nsReapAfter, true
+			}
+		}
+	}
+	return nsReapAfter, false
+}
+
+// namespaceLastUsed returns the newest time from the namespace's last used annotations.
+// An error is only returned if annotations are present but none could be parsed.
+func namespaceLastUsed(namespace corev1.Namespace) (time.Time, bool, error) {
+	var lastUsed time.Time
+	var found bool
+	var errs []error
+	for _, annotation := range strings.Split(*namespaceLastUsedAnnotation, ",") {
+		val, ok := namespace.Annotations[strings.TrimSpace(annotation)]
+		if !ok {
+			continue
+		}
+		t, err := parseAnnotationTime(val)
 		if err != nil {
-			logger.Error("Error querying Prometheus", "err", err)
-			elapsed := timeNow().Sub(startTime)
-			if elapsed < timeout {
-				logger.Info("Retrying Prometheus query", "elapsed", elapsed, "timeout", timeout)
-				time.Sleep(time.Second * 5) // Wait a bit before retrying
+			errs = append(errs, fmt.Errorf("annotation %s: %w", annotation, err))
+			continue
+		}
+		if !found || t.After(lastUsed) {
+			lastUsed = t
+			found = true
+		}
+	}
+	if !found && len(errs) > 0 {
+		return lastUsed, false, errors.Join(errs...)
+	}
+	return lastUsed, found, nil
+}
+
+// parseAnnotationTime parses a time from an annotation value. Supported formats are RFC3339,
+// Unix timestamps in seconds with optional fractional seconds, and Unix timestamps in milliseconds.
+func parseAnnotationTime(val string) (time.Time, error) {
+	val = strings.TrimSpace(val)
+	if i, err := strconv.ParseInt(val, 10, 64); err == nil {
+		// Seconds will not reach 1e12 until the year 33658 so larger values are milliseconds
+		if i >= 1e12 || i <= -1e12 {
+			return time.UnixMilli(i), nil
+		}
+		return time.Unix(i, 0), nil
+	}
+	if f, err := strconv.ParseFloat(val, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, val)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to parse %q as RFC3339 or Unix timestamp", val)
+	}
+	return t, nil
+}
+
+// idleNamespaces returns the candidate namespaces without activity within the idle threshold
+// candidateActivity returns how many candidate namespaces have activity
+func candidateActivity(namespaces []namespaceCandidate, activity map[string]time.Time) int {
+	count := 0
+	for _, namespace := range namespaces {
+		if _, ok := activity[namespace.Name]; ok {
+			count++
+		}
+	}
+	return count
+}
+
+func idleNamespaces(namespaces []namespaceCandidate, activity map[string]time.Time, logger *slog.Logger) []namespaceCandidate {
+	var idle []namespaceCandidate
+	now := timeNow()
+	metricIdle.Reset()
+	for _, namespace := range namespaces {
+		if lastActivity, ok := activity[namespace.Name]; ok {
+			namespace.LastActivity = &lastActivity
+			idleFor := now.Sub(lastActivity)
+			metricIdle.WithLabelValues(namespace.Name).Set(idleFor.Seconds())
+			if idleFor < idleAfter() {
+				logger.Debug("Skipping active namespace", "namespace", namespace.Name, "last-activity", lastActivity.String(), "idle", idleFor.String())
 				continue
 			}
-			logger.Error("Retry timeout reached", "elapsed", elapsed, "timeout", timeout)
-			return nil, err
 		}
-		break
+		idle = append(idle, namespace)
 	}
+	return idle
+}
 
-	for _, warning := range warnings {
-		logger.Warn("Warning querying Prometheus", "warning", warning)
+func reap(namespaces []namespaceCandidate, clientset kubernetes.Interface, dynamicClient dynamic.Interface, action namespaceAction, notifiers []Notifier, auditSinks []AuditSink, logger *slog.Logger) int {
+	errCount := 0
+	p := plan{DryRun: *dryRun, ReapAction: action.Name(), Time: timeNow(), Namespaces: []planEntry{}}
+	if *dryRun {
+		metricWouldReap.Reset()
+	}
+	metricHeldBack.Reset()
+	sortByIdle(namespaces, p.Time)
+	deletions := 0
+	for _, namespace := range namespaces {
+		if readyToDelete(namespace, p.Time) {
+			deletions++
+		}
+	}
+	if *maxDeletionsPerRun > 0 && deletions > *maxDeletionsPerRun {
+		deletions = *maxDeletionsPerRun
 	}
-	if result.Type() == model.ValVector {
-		vector := result.(model.Vector)
-		for _, vec := range vector {
-			if val, ok := vec.Metric["namespace"]; ok {
-				namespaces = append(namespaces, string(val))
+	var pace time.Duration
+	if *paceDeletions && !*dryRun && deletions > 1 {
+		pace = *interval / time.Duration(deletions)
+		logger.Info("Pacing deletions across interval", "deletions", deletions, "pace", pace.String())
+	}
+	deleted := 0
+	var pending []deletion
+	for _, namespace := range namespaces {
+		namespaceLogger := logger.With("namespace", namespace.Name)
+		entry := planEntry{Namespace: namespace.Name, Action: actionReap, Reason: reapReason(namespace, p.Time), LastActivity: namespace.LastActivity}
+		if *gracePeriod > 0 {
+			deleteAt, scheduled := scheduledDeletion(namespace)
+			if !scheduled {
+				deleteAt = p.Time.Add(*gracePeriod)
+				entry.Action = actionSchedule
+				entry.ScheduledDeletion = &deleteAt
+				p.Namespaces = append(p.Namespaces, entry)
+				if *dryRun {
+					namespaceLogger.Info("Dry run, would schedule namespace for deletion", "delete-at", deleteAt.String(), "reason", entry.Reason)
+					continue
+				}
+				namespaceLogger.Info("Scheduling namespace for deletion", "delete-at", deleteAt.String(), "reason", entry.Reason)
+				if err := scheduleDeletion(clientset, namespace, deleteAt, entry.Reason); err != nil {
+					errCount++
+					namespaceLogger.Error("Error scheduling namespace for deletion", "err", err)
+					metricErrorsTotal.Inc()
+				} else {
+					metricScheduledTotal.Inc()
+					notify(notifiers, newNotification(notifyEventWarned, namespace, entry, p.Time, nil), namespaceLogger)
+				}
+				continue
+			}
+			entry.ScheduledDeletion = &deleteAt
+			if p.Time.Before(deleteAt) {
+				namespaceLogger.Debug("Skipping namespace scheduled for deletion until grace period ends", "delete-at", deleteAt.String())
+				entry.Action = actionWait
+				p.Namespaces = append(p.Namespaces, entry)
+				continue
 			}
 		}
+		if *maxDeletionsPerRun > 0 && deleted >= *maxDeletionsPerRun {
+			namespaceLogger.Info("Holding back namespace, maximum deletions per run reached", "max", *maxDeletionsPerRun)
+			entry.Action = actionHold
+			metricHeldBack.WithLabelValues(namespace.Name).Set(1)
+			namespaceEvent(namespace.Name, namespace.UID, corev1.EventTypeNormal, eventReasonHeldBack, "Namespace is idle but held back, maximum deletions per run %d reached: %s", *maxDeletionsPerRun, entry.Reason)
+			p.Namespaces = append(p.Namespaces, entry)
+			continue
+		}
+		deleted++
+		p.Namespaces = append(p.Namespaces, entry)
+		if *dryRun {
+			namespaceLogger.Info("Dry run, would reap namespace", "reason", entry.Reason)
+			metricWouldReap.WithLabelValues(namespace.Name).Set(1)
+			continue
+		}
+		pending = append(pending, deletion{index: len(p.Namespaces) - 1, namespace: namespace, logger: namespaceLogger})
+	}
+	reaped, deleteErrors := deleteNamespaces(pending, &p, pace, clientset, dynamicClient, action, notifiers, auditSinks)
+	errCount += deleteErrors
+	lastPlan.set(p)
+	if *dryRun {
+		logger.Info("Dry run summary", "namespaces", p.count(actionReap))
 	} else {
-		logger.Error("Unrecognized result type", "type", result.Type())
-		return nil, err
+		logger.Info("Reap summary", "namespaces", reaped)
 	}
+	return errCount
+}
 
-	return namespaces, nil
+// deleteNamespaces reaps namespaces with a pool of workers, returning the number reaped and the number of errors.
+// When pacing, deletions are started one pace apart. The outcome of each deletion is written to the audit sinks.
+func deleteNamespaces(pending []deletion, p *plan, pace time.Duration, clientset kubernetes.Interface, dynamicClient dynamic.Interface, action namespaceAction, notifiers []Notifier, auditSinks []AuditSink) (int, int) {
+	var reaped, errCount atomic.Int64
+	jobs := make(chan deletion)
+	var wg sync.WaitGroup
+	for i := 0; i < *deleteConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range jobs {
+				// Each worker only updates the plan entry of its own namespace
+				result, err := deleteNamespace(d, &p.Namespaces[d.index], p.Time, clientset, dynamicClient, action, notifiers)
+				switch result {
+				case deleteReaped:
+					reaped.Add(1)
+				case deleteFailed:
+					errCount.Add(1)
+				}
+				record := newAuditRecord(d.namespace, p.Namespaces[d.index], action.Name(), result, err)
+				errCount.Add(int64(audit(auditSinks, record, d.logger)))
+			}
+		}()
+	}
+	for i, d := range pending {
+		if pace > 0 && i > 0 {
+			d.logger.Debug("Waiting before next deletion", "pace", pace.String())
+			sleep(pace)
+		}
+		jobs <- d
+	}
+	close(jobs)
+	wg.Wait()
+	return int(reaped.Load()), int(errCount.Load())
 }
 
-func reap(namespaces []string, activeNamespaces []string, clientset kubernetes.Interface, logger *slog.Logger) int {
-	reaped := 0
-	errCount := 0
-	for _, namespace := range namespaces {
-		namespaceLogger := logger.With("namespace", namespace)
-		if sliceContains(activeNamespaces, namespace) {
-			namespaceLogger.Debug("Skipping active namespace")
-			continue
+// deleteNamespace verifies a namespace then archives and deletes it or applies another reap action,
+// returning the error that caused a failure
+func deleteNamespace(d deletion, entry *planEntry, now time.Time, clientset kubernetes.Interface, dynamicClient dynamic.Interface, action namespaceAction, notifiers []Notifier) (deleteResult, error) {
+	namespace := d.namespace
+	namespaceLogger := d.logger
+	skipped, err := verifyNamespace(clientset, namespace, namespaceLogger)
+	if err != nil {
+		namespaceLogger.Error("Error verifying namespace before deletion, not reaping", "err", err)
+		metricErrorsTotal.Inc()
+		notify(notifiers, newNotification(notifyEventFailed, namespace, *entry, now, err), namespaceLogger)
+		return deleteFailed, err
+	}
+	if skipped != "" {
+		namespaceLogger.Info("Not reaping namespace that changed since it was evaluated", "skipped", skipped)
+		entry.Action = actionSkip
+		entry.Skipped = skipped
+		metricSkippedTotal.Inc()
+		skippedEvent(namespace.Name, namespace.UID, skipped, "Namespace not reaped, %s", skipped)
+		return deleteSkipped, nil
+	}
+	if *archiveDir != "" && action.Name() == reapActionDelete {
+		ctx := context.Background()
+		if *archiveTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, *archiveTimeout)
+			defer cancel()
 		}
-		namespaceLogger.Info("Reaping namespace")
-		err := clientset.CoreV1().Namespaces().Delete(context.TODO(), namespace, metav1.DeleteOptions{})
+		archive, err := archiveNamespace(ctx, clientset.Discovery(), dynamicClient, namespace.Name, namespaceLogger)
 		if err != nil {
-			errCount++
-			namespaceLogger.Error("Error deleting namespace", "err", err)
+			namespaceLogger.Error("Error archiving namespace, not reaping", "err", err)
 			metricErrorsTotal.Inc()
-		} else {
-			reaped++
-			metricReapedTotal.Inc()
+			metricArchivesTotal.WithLabelValues("error").Inc()
+			notify(notifiers, newNotification(notifyEventFailed, namespace, *entry, now, err), namespaceLogger)
+			return deleteFailed, err
 		}
+		metricArchivesTotal.WithLabelValues("success").Inc()
+		entry.Archive = archive
+	}
+	namespaceLogger.Info("Reaping namespace", "action", action.Name(), "reason", entry.Reason)
+	namespaceEvent(namespace.Name, namespace.UID, corev1.EventTypeWarning, eventReasonReaping, "Namespace is idle and is being reaped with action %s: %s", action.Name(), entry.Reason)
+	if err := applyWithTimeout(action, clientset, namespace); err != nil {
+		if apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+			namespaceLogger.Info("Not reaping namespace that changed before it could be reaped", "err", err)
+			entry.Action = actionSkip
+			entry.Skipped = "namespace changed before it could be reaped"
+			metricSkippedTotal.Inc()
+			return deleteSkipped, nil
+		}
+		namespaceLogger.Error("Error reaping namespace", "action", action.Name(), "err", err)
+		metricErrorsTotal.Inc()
+		notify(notifiers, newNotification(notifyEventFailed, namespace, *entry, now, err), namespaceLogger)
+		return deleteFailed, err
+	}
+	entry.Reaped = true
+	if action.Name() == reapActionDelete {
+		terminations.add(namespace.Name, namespace.UID, now)
+	}
+	metricReapedTotal.Inc()
+	reaperEvent(corev1.EventTypeWarning, eventReasonNamespaceReaped, "Namespace %s reaped with action %s: %s", namespace.Name, action.Name(), entry.Reason)
+	notify(notifiers, newNotification(notifyEventReaped, namespace, *entry, now, nil), namespaceLogger)
+	return deleteReaped, nil
+}
+
+// namespaceAction is what is done to idle namespaces that are reaped
+type namespaceAction interface {
+	Name() string
+	Apply(ctx context.Context, clientset kubernetes.Interface, namespace namespaceCandidate) error
+}
+
+// namespaceDeleter deletes namespaces
+type namespaceDeleter struct{}
+
+func (namespaceDeleter) Name() string {
+	return reapActionDelete
+}
+
+func (namespaceDeleter) Apply(ctx context.Context, clientset kubernetes.Interface, namespace namespaceCandidate) error {
+	marked, err := markDeleted(ctx, clientset, namespace)
+	if err != nil {
+		return err
+	}
+	// Preconditions ensure a namespace recreated with the same name or changed since it was evaluated is not deleted
+	opts := metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{
+			UID:             &namespace.UID,
+			ResourceVersion: &marked.ResourceVersion,
+		},
+	}
+	return clientset.CoreV1().Namespaces().Delete(ctx, namespace.Name, opts)
+}
+
+func getNamespaceAction() namespaceAction {
+	if *reapAction == reapActionQuarantine {
+		return namespaceQuarantiner{}
+	}
+	return namespaceDeleter{}
+}
+
+// applyWithTimeout applies the reap action to a namespace, returning once the delete timeout is reached even if
+// the API calls have not so a hung call can not stall the worker
+func applyWithTimeout(action namespaceAction, clientset kubernetes.Interface, namespace namespaceCandidate) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *deleteTimeout)
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		result <- action.Apply(ctx, clientset, namespace)
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timed out after %s reaping namespace: %w", *deleteTimeout, ctx.Err())
+	}
+}
+
+// sortByIdle orders namespaces longest idle first. Namespaces with no activity within their reap after
+// are the longest idle and are ordered by age, ties are ordered by name so the order is deterministic.
+func sortByIdle(namespaces []namespaceCandidate, now time.Time) {
+	idle := func(namespace namespaceCandidate) time.Duration {
+		if namespace.LastActivity == nil {
+			return time.Duration(math.MaxInt64)
+		}
+		return now.Sub(*namespace.LastActivity)
+	}
+	sort.SliceStable(namespaces, func(i, j int) bool {
+		if idleI, idleJ := idle(namespaces[i]), idle(namespaces[j]); idleI != idleJ {
+			return idleI > idleJ
+		}
+		if namespaces[i].Age != namespaces[j].Age {
+			return namespaces[i].Age > namespaces[j].Age
+		}
+		return namespaces[i].Name < namespaces[j].Name
+	})
+}
+
+// readyToDelete returns true if a namespace will be deleted this run rather than scheduled or waiting for its grace period
+func readyToDelete(namespace namespaceCandidate, now time.Time) bool {
+	if *gracePeriod <= 0 {
+		return true
+	}
+	deleteAt, scheduled := scheduledDeletion(namespace)
+	return scheduled && !now.Before(deleteAt)
+}
+
+func reapReason(namespace namespaceCandidate, now time.Time) string {
+	reason := fmt.Sprintf("age %s exceeds reap-after %s", namespace.Age.String(), namespace.ReapAfter.String())
+	if namespace.LastActivity != nil {
+		reason += fmt.Sprintf(", idle for %s exceeds idle-threshold %s", now.Sub(*namespace.LastActivity).String(), idleAfter().String())
+	} else {
+		reason += fmt.Sprintf(", no activity within %s", (*reapAfter).String())
+	}
+	if namespace.LastUsed != nil {
+		reason += fmt.Sprintf(", last used %s ago exceeds last-used-threshold %s",
+			namespace.LastUsed.String(), (*lastUsedThreshold).String())
+	}
+	return reason
+}
+
+// idleAfter returns how long since last activity before a namespace is idle
+func idleAfter() time.Duration {
+	if *idleThreshold == 0 {
+		return *reapAfter
+	}
+	return *idleThreshold
+}
+
+func planHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(lastPlan.get()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
-	logger.Info("Reap summary", "namespaces", reaped)
-	return errCount
 }
 
 func metricGathers() prometheus.Gatherers {
 	registry := prometheus.NewRegistry()
 	registry.MustRegister(metricBuildInfo)
+	registry.MustRegister(metricScheduledTotal)
 	registry.MustRegister(metricReapedTotal)
 	registry.MustRegister(metricError)
 	registry.MustRegister(metricErrorsTotal)
+	registry.MustRegister(metricSafetyAbortsTotal)
+	registry.MustRegister(metricPrometheusQueryAttemptsTotal)
+	registry.MustRegister(metricPrometheusQueryDuration)
+	registry.MustRegister(metricPrometheusQueriesTotal)
+	registry.MustRegister(metricNotificationsTotal)
+	registry.MustRegister(metricArchivesTotal)
+	registry.MustRegister(metricArchiveDiscoveryFailuresTotal)
+	registry.MustRegister(metricAuditRecordsTotal)
 	registry.MustRegister(metricDuration)
+	registry.MustRegister(metricLeader)
+	registry.MustRegister(metricIdle)
+	registry.MustRegister(metricDryRun)
+	registry.MustRegister(metricWouldReap)
+	registry.MustRegister(metricHeldBack)
+	registry.MustRegister(metricSkippedTotal)
+	registry.MustRegister(metricTerminationDuration)
+	registry.MustRegister(metricTerminating)
+	registry.MustRegister(metricStuckTerminating)
+	registry.MustRegister(metricTerminationBlocked)
+	registry.MustRegister(metricFinalizersRemovedTotal)
 	gatherers := prometheus.Gatherers{registry}
 	if *processMetrics {
 		gatherers = append(gatherers, prometheus.DefaultGatherer)
@@ -367,11 +1285,10 @@ func metricGathers() prometheus.Gatherers {
 	return gatherers
 }
 
-func sliceContains(slice []string, str string) bool {
-	for _, s := range slice {
-		if str == s {
-			return true
-		}
+func candidateNames(candidates []namespaceCandidate) []string {
+	names := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		names = append(names, c.Name)
 	}
-	return false
+	return names
 }
@@ -15,6 +15,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -28,12 +29,17 @@ import (
 	"time"
 
 	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/common/promslog"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
 )
 
 var (
@@ -90,7 +96,8 @@ func TestGetNamespacesByLabel(t *testing.T) {
 	}
 	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
 	clientset := clientset()
-	namespaces, err := getNamespaces(clientset, logger)
+	candidates, err := getNamespaces(clientset, logger)
+	namespaces := candidateNames(candidates)
 	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
 	}
@@ -114,7 +121,8 @@ func TestGetNamespacesByLabelLargerAge(t *testing.T) {
 	}
 	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
 	clientset := clientset()
-	namespaces, err := getNamespaces(clientset, logger)
+	candidates, err := getNamespaces(clientset, logger)
+	namespaces := candidateNames(candidates)
 	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
 	}
@@ -138,7 +146,8 @@ func TestGetNamespacesByRegexp(t *testing.T) {
 	}
 	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
 	clientset := clientset()
-	namespaces, err := getNamespaces(clientset, logger)
+	candidates, err := getNamespaces(clientset, logger)
+	namespaces := candidateNames(candidates)
 	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
 	}
@@ -167,7 +176,8 @@ func TestGetNamespacesLastUsedAnnotation(t *testing.T) {
 	}
 	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
 	clientset := clientset()
-	namespaces, err := getNamespaces(clientset, logger)
+	candidates, err := getNamespaces(clientset, logger)
+	namespaces := candidateNames(candidates)
 	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
 	}
@@ -177,7 +187,8 @@ func TestGetNamespacesLastUsedAnnotation(t *testing.T) {
 	timeNow = func() time.Time {
 		return creationTime.Add((time.Hour * 24 * 8) + time.Hour)
 	}
-	namespaces, err = getNamespaces(clientset, logger)
+	candidates, err = getNamespaces(clientset, logger)
+	namespaces = candidateNames(candidates)
 	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
 	}
@@ -192,6 +203,86 @@ func TestGetNamespacesLastUsedAnnotation(t *testing.T) {
 	}
 }
 
+func TestGetNamespacesLastUsedAnnotations(t *testing.T) {
+	now := creationTime.Add((time.Hour * 24 * 9))
+	newNamespace := func(name string, annotations map[string]string) *v1.Namespace {
+		return &v1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				Annotations:       annotations,
+				CreationTimestamp: metav1.NewTime(creationTime),
+			},
+		}
+	}
+	recent := now.Add(-time.Hour)
+	old := now.Add(-time.Hour * 24)
+	clientset := fake.NewSimpleClientset(
+		newNamespace("user-ood", map[string]string{"ood/last-used": fmt.Sprintf("%d", recent.Unix())}),
+		newNamespace("user-jupyter", map[string]string{"jupyter/last-used": recent.Format(time.RFC3339)}),
+		newNamespace("user-ci", map[string]string{"ci/last-used": fmt.Sprintf("%d", recent.UnixMilli())}),
+		newNamespace("user-newest", map[string]string{
+			"ood/last-used":     fmt.Sprintf("%d.5", old.Unix()),
+			"jupyter/last-used": recent.Format(time.RFC3339Nano),
+		}),
+		newNamespace("user-old", map[string]string{
+			"ood/last-used": fmt.Sprintf("%d", old.Unix()),
+			"ci/last-used":  "foo",
+		}),
+		newNamespace("user-invalid", map[string]string{"ci/last-used": "foo"}),
+	)
+	args := []string{
+		"--prometheus-address=foobar",
+		"--namespace-regexp=user-.+",
+		"--namespace-last-used-annotation=ood/last-used,jupyter/last-used,ci/last-used",
+	}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	timeNow = func() time.Time {
+		return now
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	candidates, err := getNamespaces(clientset, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	namespaces := candidateNames(candidates)
+	expected := []string{"user-old"}
+	if !reflect.DeepEqual(namespaces, expected) {
+		t.Errorf("Unexpected value for namespaces\nExpected: %v\nGot: %v", expected, namespaces)
+	}
+}
+
+func TestParseAnnotationTime(t *testing.T) {
+	expected := time.Date(2020, 1, 8, 19, 0, 0, 0, time.UTC)
+	tests := []struct {
+		val      string
+		expected time.Time
+	}{
+		{val: "1578510000", expected: expected},
+		{val: "1578510000000", expected: expected},
+		{val: "1578510000.25", expected: expected.Add(time.Millisecond * 250)},
+		{val: "2020-01-08T19:00:00Z", expected: expected},
+		{val: "2020-01-08T14:00:00-05:00", expected: expected},
+		{val: "2020-01-08T19:00:00.5Z", expected: expected.Add(time.Millisecond * 500)},
+	}
+	for _, test := range tests {
+		got, err := parseAnnotationTime(test.val)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %s: %v", test.val, err)
+			continue
+		}
+		if !got.Equal(test.expected) {
+			t.Errorf("Unexpected time parsing %s\nExpected: %v\nGot: %v", test.val, test.expected, got)
+		}
+	}
+	for _, val := range []string{"foo", "", "NaN", "2020-01-08"} {
+		if _, err := parseAnnotationTime(val); err == nil {
+			t.Errorf("Expected error parsing %q", val)
+		}
+	}
+}
+
 func TestGetNamespacesByRegexpAndLabel(t *testing.T) {
 	args := []string{
 		"--prometheus-address=foobar",
@@ -206,7 +297,8 @@ func TestGetNamespacesByRegexpAndLabel(t *testing.T) {
 	}
 	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
 	clientset := clientset()
-	namespaces, err := getNamespaces(clientset, logger)
+	candidates, err := getNamespaces(clientset, logger)
+	namespaces := candidateNames(candidates)
 	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
 	}
@@ -221,40 +313,205 @@ func TestGetNamespacesByRegexpAndLabel(t *testing.T) {
 	}
 }
 
-func TestGetActiveNamespaces(t *testing.T) {
-	queryResults, err := os.ReadFile("testdata/prometheus-query.json")
+func TestGetNamespacesMultipleSelectors(t *testing.T) {
+	args := []string{
+		"--prometheus-address=foobar",
+		"--namespace-labels=app.kubernetes.io/name=open-ondemand; app.kubernetes.io/name in (open-ondemand,foo)",
+	}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	timeNow = func() time.Time {
+		return creationTime.Add((time.Hour * 24 * 9))
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	clientset := clientset()
+	candidates, err := getNamespaces(clientset, logger)
 	if err != nil {
-		t.Fatalf("Error loading fixture data: %s", err.Error())
+		t.Errorf("Unexpected error: %v", err)
+	}
+	namespaces := candidateNames(candidates)
+	expected := []string{"user-user1", "user-user2", "user-user3"}
+	sort.Strings(namespaces)
+	if !reflect.DeepEqual(namespaces, expected) {
+		t.Errorf("Unexpected value for namespaces\nExpected: %v\nGot: %v", expected, namespaces)
 	}
 
-	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-		_, _ = rw.Write(queryResults)
-	}))
-	defer server.Close()
-	address, _ := url.Parse(server.URL)
-	args := []string{fmt.Sprintf("--prometheus-address=%s", address)}
+	args = []string{
+		"--prometheus-address=foobar",
+		"--namespace-labels=app.kubernetes.io/name=open-ondemand,app.kubernetes.io/name!=open-ondemand",
+	}
 	if _, err := kingpin.CommandLine.Parse(args); err != nil {
 		t.Fatal(err)
 	}
-	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	candidates, err = getNamespaces(clientset, logger)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if len(candidates) != 0 {
+		t.Errorf("Unexpected number of namespaces: %d", len(candidates))
+	}
+}
 
-	activeNamespaces, err := getActiveNamespaces(logger)
+func TestNamespaceListOptions(t *testing.T) {
+	args := []string{
+		"--prometheus-address=foobar",
+		"--namespace-labels=team=a,tier=dev;env in (dev,test)",
+		"--namespace-fields=status.phase=Active",
+	}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	listOptions, err := namespaceListOptions()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []metav1.ListOptions{
+		{LabelSelector: "team=a,tier=dev", FieldSelector: "status.phase=Active"},
+		{LabelSelector: "env in (dev,test)", FieldSelector: "status.phase=Active"},
+	}
+	if !reflect.DeepEqual(listOptions, expected) {
+		t.Errorf("Unexpected list options\nExpected: %v\nGot: %v", expected, listOptions)
+	}
+	if _, err := kingpin.CommandLine.Parse([]string{"--prometheus-address=foobar"}); err != nil {
+		t.Fatal(err)
+	}
+	listOptions, err = namespaceListOptions()
 	if err != nil {
-		t.Errorf("Unexpected error %s", err.Error())
-		return
+		t.Fatalf("Unexpected error: %v", err)
 	}
-	if len(activeNamespaces) != 2 {
-		t.Errorf("Unexpected number activeNamespaces, got %d", len(activeNamespaces))
-		return
+	if !reflect.DeepEqual(listOptions, []metav1.ListOptions{{}}) {
+		t.Errorf("Unexpected list options: %v", listOptions)
 	}
-	expectedActiveNamespaces := []string{"user-user1", "user-user3"}
-	sort.Strings(activeNamespaces)
-	sort.Strings(expectedActiveNamespaces)
-	if !reflect.DeepEqual(activeNamespaces, expectedActiveNamespaces) {
-		t.Errorf("Unexpected value for active namespaces\nExpected %v\nGot %v\n", expectedActiveNamespaces, activeNamespaces)
+	if _, err := kingpin.CommandLine.Parse([]string{"--prometheus-address=foobar", "--namespace-labels=env in dev"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := namespaceListOptions(); err == nil {
+		t.Errorf("Expected error for invalid label selector")
 	}
 }
 
+func TestGetNamespacesExcluded(t *testing.T) {
+	args := []string{
+		"--prometheus-address=foobar",
+		"--namespace-regexp=user-.+",
+		"--namespace-exclude-regexp=user-user1",
+		"--namespace-exclude-labels=app.kubernetes.io/name=foo",
+	}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	timeNow = func() time.Time {
+		return creationTime.Add((time.Hour * 24 * 9))
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	clientset := clientset()
+	candidates, err := getNamespaces(clientset, logger)
+	namespaces := candidateNames(candidates)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	expected := []string{"user-user2"}
+	if !reflect.DeepEqual(namespaces, expected) {
+		t.Errorf("Unexpected value for namespaces\nExpected: %v\nGot: %v", expected, namespaces)
+	}
+}
+
+func TestGetNamespacesOverrides(t *testing.T) {
+	now := creationTime.Add((time.Hour * 24 * 9))
+	newNamespace := func(name string, annotations map[string]string) *v1.Namespace {
+		return &v1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				Annotations:       annotations,
+				CreationTimestamp: metav1.NewTime(creationTime),
+			},
+		}
+	}
+	clientset := fake.NewSimpleClientset(
+		newNamespace("user-none", nil),
+		newNamespace("user-optout", map[string]string{"reaper/opt-out": "true"}),
+		newNamespace("user-optout-false", map[string]string{"reaper/opt-out": "false"}),
+		newNamespace("user-reap-after", map[string]string{"reaper/reap-after": "240h"}),
+		newNamespace("user-reap-after-short", map[string]string{"reaper/reap-after": "24h"}),
+		newNamespace("user-reap-after-invalid", map[string]string{"reaper/reap-after": "foo"}),
+		newNamespace("user-extend", map[string]string{"reaper/extend-until": now.Add(time.Hour * 24 * 30).Format(time.RFC3339)}),
+		newNamespace("user-extend-past", map[string]string{"reaper/extend-until": fmt.Sprintf("%d", now.Add(-time.Hour).Unix())}),
+	)
+	baseArgs := []string{
+		"--prometheus-address=foobar",
+		"--namespace-regexp=user-.+",
+		"--namespace-opt-out-annotation=reaper/opt-out",
+		"--namespace-reap-after-annotation=reaper/reap-after",
+		"--namespace-extend-until-annotation=reaper/extend-until",
+	}
+	timeNow = func() time.Time {
+		return now
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	tests := []struct {
+		name     string
+		args     []string
+		expected []string
+	}{
+		{
+			name:     "no limit",
+			args:     baseArgs,
+			expected: []string{"user-extend-past", "user-none", "user-optout-false", "user-reap-after-invalid", "user-reap-after-short"},
+		},
+		{
+			name:     "max override",
+			args:     append(append([]string{}, baseArgs...), "--namespace-override-max=72h"),
+			expected: []string{"user-extend-past", "user-none", "user-optout-false", "user-reap-after-invalid", "user-reap-after-short"},
+		},
+		{
+			name:     "max override reached",
+			args:     append(append([]string{}, baseArgs...), "--namespace-override-max=24h"),
+			expected: []string{"user-extend", "user-extend-past", "user-none", "user-optout", "user-optout-false", "user-reap-after", "user-reap-after-invalid", "user-reap-after-short"},
+		},
+		{
+			// Extend until is limited to reap-after plus the max override from creation, which is now
+			name:     "max override expired",
+			args:     append(append([]string{}, baseArgs...), "--namespace-override-max=48h"),
+			expected: []string{"user-extend", "user-extend-past", "user-none", "user-optout", "user-optout-false", "user-reap-after", "user-reap-after-invalid", "user-reap-after-short"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := kingpin.CommandLine.Parse(test.args); err != nil {
+				t.Fatal(err)
+			}
+			candidates, err := getNamespaces(clientset, logger)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			namespaces := candidateNames(candidates)
+			sort.Strings(namespaces)
+			if !reflect.DeepEqual(namespaces, test.expected) {
+				t.Errorf("Unexpected value for namespaces\nExpected: %v\nGot: %v", test.expected, namespaces)
+			}
+		})
+	}
+}
+
+// resetRunCounters replaces the counters other tests also increment so exact totals can be compared
+func resetRunCounters(t *testing.T) {
+	reapedTotal, errorsTotal := metricReapedTotal, metricErrorsTotal
+	metricReapedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reaped_total",
+		Help:      "Total number of namespaces reaped",
+	})
+	metricErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "errors_total",
+		Help:      "Total number of errors",
+	})
+	t.Cleanup(func() {
+		metricReapedTotal, metricErrorsTotal = reapedTotal, errorsTotal
+	})
+}
+
 func TestRun(t *testing.T) {
 	queryResults, err := os.ReadFile("testdata/prometheus-query.json")
 	if err != nil {
@@ -276,8 +533,9 @@ func TestRun(t *testing.T) {
 		return creationTime.Add((time.Hour * 24 * 9))
 	}
 
+	resetRunCounters(t)
 	clientset := clientset()
-	err = run(clientset, logger)
+	err = run(clientset, nil, logger)
 	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
 	}
@@ -307,9 +565,516 @@ func TestRun(t *testing.T) {
 	}
 }
 
+func TestRunDryRun(t *testing.T) {
+	queryResults, err := os.ReadFile("testdata/prometheus-query.json")
+	if err != nil {
+		t.Fatalf("Error loading fixture data: %s", err.Error())
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write(queryResults)
+	}))
+	defer server.Close()
+	address, _ := url.Parse(server.URL)
+	args := []string{"--namespace-labels=app.kubernetes.io/name=open-ondemand", fmt.Sprintf("--prometheus-address=%s", address), "--dry-run"}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	timeNow = func() time.Time {
+		return creationTime.Add((time.Hour * 24 * 9))
+	}
+
+	clientset := clientset()
+	err = run(clientset, nil, logger)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	namespaces, err := clientset.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Errorf("Unexpected error getting namespaces: %v", err)
+	}
+	if len(namespaces.Items) != 4 {
+		t.Errorf("Unexpected number of namespaces, got: %d", len(namespaces.Items))
+	}
+
+	expected := `
+	# HELP k8_namespace_reaper_would_reap Namespaces that would have been reaped during last dry run
+	# TYPE k8_namespace_reaper_would_reap gauge
+	k8_namespace_reaper_would_reap{namespace="user-user2"} 1
+	`
+	if err := testutil.GatherAndCompare(metricGathers(), strings.NewReader(expected),
+		"k8_namespace_reaper_would_reap"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+
+	rec := httptest.NewRecorder()
+	planHandler(rec, httptest.NewRequest(http.MethodGet, planPath, nil))
+	var p plan
+	if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+		t.Fatalf("Unexpected error decoding plan: %v", err)
+	}
+	if !p.DryRun {
+		t.Errorf("Expected plan to be dry run")
+	}
+	if len(p.Namespaces) != 1 {
+		t.Fatalf("Unexpected number of plan namespaces, got: %d", len(p.Namespaces))
+	}
+	if p.Namespaces[0].Namespace != "user-user2" || p.Namespaces[0].Reaped {
+		t.Errorf("Unexpected plan entry: %+v", p.Namespaces[0])
+	}
+	if !strings.Contains(p.Namespaces[0].Reason, "exceeds reap-after 168h0m0s") {
+		t.Errorf("Unexpected plan reason: %s", p.Namespaces[0].Reason)
+	}
+}
+
+func TestRunGracePeriod(t *testing.T) {
+	queryResults, err := os.ReadFile("testdata/prometheus-query.json")
+	if err != nil {
+		t.Fatalf("Error loading fixture data: %s", err.Error())
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write(queryResults)
+	}))
+	defer server.Close()
+	address, _ := url.Parse(server.URL)
+	args := []string{"--namespace-labels=app.kubernetes.io/name=open-ondemand", fmt.Sprintf("--prometheus-address=%s", address), "--grace-period=1h"}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	now := creationTime.Add((time.Hour * 24 * 9))
+	timeNow = func() time.Time {
+		return now
+	}
+
+	recorder := record.NewFakeRecorder(100)
+	eventRecorder = recorder
+	defer func() { eventRecorder = &record.FakeRecorder{} }()
+
+	clientset := clientset()
+	user1, err := clientset.CoreV1().Namespaces().Get(context.TODO(), "user-user1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error getting namespace: %v", err)
+	}
+	user1.Annotations = map[string]string{"k8-namespace-reaper.osc.edu/scheduled-deletion": "2020-01-10T12:00:00Z"}
+	if _, err := clientset.CoreV1().Namespaces().Update(context.TODO(), user1, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Unexpected error updating namespace: %v", err)
+	}
+
+	err = run(clientset, nil, logger)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	namespaces, err := clientset.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Errorf("Unexpected error getting namespaces: %v", err)
+	}
+	if len(namespaces.Items) != 4 {
+		t.Errorf("Unexpected number of namespaces, got: %d", len(namespaces.Items))
+	}
+	for _, namespace := range namespaces.Items {
+		val, ok := namespace.Annotations["k8-namespace-reaper.osc.edu/scheduled-deletion"]
+		switch namespace.Name {
+		case "user-user2":
+			if val != "2020-01-10T14:00:00Z" {
+				t.Errorf("Unexpected scheduled deletion for %s: %s", namespace.Name, val)
+			}
+		default:
+			if ok {
+				t.Errorf("Unexpected scheduled deletion for %s: %s", namespace.Name, val)
+			}
+		}
+	}
+	if events := recordedEvents(recorder); !reflect.DeepEqual(events, []string{"Normal " + eventReasonUnscheduled, "Warning " + eventReasonScheduled}) {
+		t.Errorf("Unexpected events: %v", events)
+	}
+	if p := lastPlan.get(); len(p.Namespaces) != 1 || p.Namespaces[0].Action != actionSchedule {
+		t.Errorf("Unexpected plan: %+v", p)
+	}
+
+	now = now.Add(30 * time.Minute)
+	err = run(clientset, nil, logger)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := clientset.CoreV1().Namespaces().Get(context.TODO(), "user-user2", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected namespace to remain during grace period: %v", err)
+	}
+	if p := lastPlan.get(); len(p.Namespaces) != 1 || p.Namespaces[0].Action != actionWait {
+		t.Errorf("Unexpected plan: %+v", p)
+	}
+
+	now = now.Add(time.Hour)
+	err = run(clientset, nil, logger)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	namespaces, err = clientset.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Errorf("Unexpected error getting namespaces: %v", err)
+	}
+	if len(namespaces.Items) != 3 {
+		t.Errorf("Unexpected number of namespaces, got: %d", len(namespaces.Items))
+	}
+	for _, namespace := range namespaces.Items {
+		if namespace.Name == "user-user2" {
+			t.Errorf("Namespace %s should have been reaped", namespace.Name)
+		}
+	}
+}
+
+func TestSortByIdle(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	now := creationTime.Add(time.Hour * 24 * 9)
+	recent := now.Add(-time.Hour)
+	old := now.Add(-time.Hour * 24)
+	namespaces := []namespaceCandidate{
+		{Name: "recent", Age: time.Hour * 200, LastActivity: &recent},
+		{Name: "none-young", Age: time.Hour * 170},
+		{Name: "old-b", Age: time.Hour * 200, LastActivity: &old},
+		{Name: "none-old", Age: time.Hour * 300},
+		{Name: "old-a", Age: time.Hour * 200, LastActivity: &old},
+	}
+	sortByIdle(namespaces, now)
+	var names []string
+	for _, namespace := range namespaces {
+		names = append(names, namespace.Name)
+	}
+	expected := []string{"none-old", "none-young", "old-a", "old-b", "recent"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Unexpected order\nExpected: %v\nGot: %v", expected, names)
+	}
+}
+
+func TestRunMaxDeletions(t *testing.T) {
+	queryResults, err := os.ReadFile("testdata/prometheus-query.json")
+	if err != nil {
+		t.Fatalf("Error loading fixture data: %s", err.Error())
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write(queryResults)
+	}))
+	defer server.Close()
+	address, _ := url.Parse(server.URL)
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	timeNow = func() time.Time {
+		return creationTime.Add((time.Hour * 24 * 9))
+	}
+	var sleeps []time.Duration
+	sleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+	}
+	defer func() { sleep = time.Sleep }()
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected []string
+		heldBack string
+		sleeps   []time.Duration
+	}{
+		{name: "max", args: []string{"--max-deletions-per-run=1"}, expected: []string{"test", "user-user1", "user-user3"}, heldBack: `k8_namespace_reaper_held_back{namespace="user-user1"} 1`},
+		{name: "paced", args: []string{"--pace-deletions"}, expected: []string{"test", "user-user3"}, sleeps: []time.Duration{time.Hour * 3}},
+		{name: "max paced", args: []string{"--max-deletions-per-run=1", "--pace-deletions"}, expected: []string{"test", "user-user1", "user-user3"}, heldBack: `k8_namespace_reaper_held_back{namespace="user-user1"} 1`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sleeps = nil
+			args := append([]string{
+				"--namespace-labels=app.kubernetes.io/name=open-ondemand",
+				fmt.Sprintf("--prometheus-address=%s", address),
+				"--idle-threshold=30m",
+			}, test.args...)
+			if _, err := kingpin.CommandLine.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+			clientset := clientset()
+			if err := run(clientset, nil, logger); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			namespaces, err := clientset.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				t.Errorf("Unexpected error getting namespaces: %v", err)
+			}
+			var names []string
+			for _, namespace := range namespaces.Items {
+				names = append(names, namespace.Name)
+			}
+			if !reflect.DeepEqual(names, test.expected) {
+				t.Errorf("Unexpected namespaces\nExpected: %v\nGot: %v", test.expected, names)
+			}
+			if !reflect.DeepEqual(sleeps, test.sleeps) {
+				t.Errorf("Unexpected sleeps\nExpected: %v\nGot: %v", test.sleeps, sleeps)
+			}
+			expected := `
+	# HELP k8_namespace_reaper_held_back Namespaces held back during last run by the maximum deletions per run
+	# TYPE k8_namespace_reaper_held_back gauge
+	` + test.heldBack + "\n"
+			if test.heldBack == "" {
+				expected = ""
+			}
+			if err := testutil.GatherAndCompare(metricGathers(), strings.NewReader(expected), "k8_namespace_reaper_held_back"); err != nil {
+				t.Errorf("unexpected collecting result:\n%s", err)
+			}
+		})
+	}
+}
+
+// latencyClientset delays namespace deletes outside of the fake clientset, which serializes reactors
+type latencyClientset struct {
+	*fake.Clientset
+	latency func(name string)
+}
+
+type latencyCoreV1 struct {
+	corev1client.CoreV1Interface
+	latency func(name string)
+}
+
+type latencyNamespaces struct {
+	corev1client.NamespaceInterface
+	latency func(name string)
+}
+
+func (c *latencyClientset) CoreV1() corev1client.CoreV1Interface {
+	return &latencyCoreV1{CoreV1Interface: c.Clientset.CoreV1(), latency: c.latency}
+}
+
+func (c *latencyCoreV1) Namespaces() corev1client.NamespaceInterface {
+	return &latencyNamespaces{NamespaceInterface: c.CoreV1Interface.Namespaces(), latency: c.latency}
+}
+
+func (n *latencyNamespaces) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
+	n.latency(name)
+	return n.NamespaceInterface.Delete(ctx, name, opts)
+}
+
+func TestReapConcurrent(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	timeNow = func() time.Time {
+		return creationTime.Add((time.Hour * 24 * 9))
+	}
+	hung := make(chan struct{})
+	defer close(hung)
+
+	tests := []struct {
+		name        string
+		args        []string
+		namespaces  []string
+		maxDuration time.Duration
+		errors      int
+		reaped      []string
+	}{
+		{
+			name:        "slow",
+			args:        []string{"--delete-concurrency=3"},
+			namespaces:  []string{"slow-1", "slow-2", "slow-3", "slow-4", "slow-5", "slow-6"},
+			maxDuration: 1200 * time.Millisecond,
+			reaped:      []string{"slow-1", "slow-2", "slow-3", "slow-4", "slow-5", "slow-6"},
+		},
+		{
+			name:        "failing",
+			args:        []string{"--delete-concurrency=2", "--delete-timeout=1s"},
+			namespaces:  []string{"fail-1", "hung-1", "slow-1", "fail-2", "slow-2"},
+			maxDuration: 3 * time.Second,
+			errors:      3,
+			reaped:      []string{"slow-1", "slow-2"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := kingpin.CommandLine.Parse(test.args); err != nil {
+				t.Fatal(err)
+			}
+			var objects []runtime.Object
+			var namespaces []namespaceCandidate
+			for _, name := range test.namespaces {
+				objects = append(objects, &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}})
+				namespaces = append(namespaces, namespaceCandidate{Name: name, Age: time.Hour * 200, ReapAfter: time.Hour * 168})
+			}
+			fakeClientset := fake.NewSimpleClientset(objects...)
+			fakeClientset.PrependReactor("delete", "namespaces", func(action clienttesting.Action) (bool, runtime.Object, error) {
+				if name := action.(clienttesting.DeleteAction).GetName(); strings.HasPrefix(name, "fail-") {
+					return true, nil, fmt.Errorf("failed to delete %s", name)
+				}
+				return false, nil, nil
+			})
+			clientset := &latencyClientset{Clientset: fakeClientset, latency: func(name string) {
+				switch {
+				case strings.HasPrefix(name, "slow-"):
+					time.Sleep(300 * time.Millisecond)
+				case strings.HasPrefix(name, "hung-"):
+					<-hung
+				}
+			}}
+			reapedBefore := testutil.ToFloat64(metricReapedTotal)
+			errorsBefore := testutil.ToFloat64(metricErrorsTotal)
+
+			start := time.Now()
+			errCount := reap(namespaces, clientset, nil, namespaceDeleter{}, nil, nil, logger)
+			if duration := time.Since(start); duration > test.maxDuration {
+				t.Errorf("Deletes took too long, expected less than %s got %s", test.maxDuration, duration)
+			}
+			if errCount != test.errors {
+				t.Errorf("Unexpected error count, expected: %d got: %d", test.errors, errCount)
+			}
+			if reaped := testutil.ToFloat64(metricReapedTotal) - reapedBefore; int(reaped) != len(test.reaped) {
+				t.Errorf("Unexpected reaped total, expected: %d got: %v", len(test.reaped), reaped)
+			}
+			if errors := testutil.ToFloat64(metricErrorsTotal) - errorsBefore; int(errors) != test.errors {
+				t.Errorf("Unexpected errors total, expected: %d got: %v", test.errors, errors)
+			}
+			var reaped []string
+			p := lastPlan.get()
+			for _, entry := range p.Namespaces {
+				if entry.Reaped {
+					reaped = append(reaped, entry.Namespace)
+				}
+			}
+			sort.Strings(reaped)
+			if !reflect.DeepEqual(reaped, test.reaped) {
+				t.Errorf("Unexpected reaped namespaces in plan\nExpected: %v\nGot: %v", test.reaped, reaped)
+			}
+		})
+	}
+}
+
+func TestRunIdleThreshold(t *testing.T) {
+	queryResults, err := os.ReadFile("testdata/prometheus-query.json")
+	if err != nil {
+		t.Fatalf("Error loading fixture data: %s", err.Error())
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write(queryResults)
+	}))
+	defer server.Close()
+	args := []string{"--namespace-regexp=user-.+", fmt.Sprintf("--prometheus-address=%s", server.URL), "--idle-threshold=12h", "--dry-run"}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	timeNow = func() time.Time {
+		return creationTime.Add((time.Hour * 24 * 9))
+	}
+
+	if err := run(clientset(), nil, logger); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	p := lastPlan.get()
+	var planned []string
+	for _, entry := range p.Namespaces {
+		planned = append(planned, entry.Namespace)
+	}
+	sort.Strings(planned)
+	expected := []string{"user-user2", "user-user3"}
+	if !reflect.DeepEqual(planned, expected) {
+		t.Errorf("Unexpected value for planned namespaces\nExpected: %v\nGot: %v", expected, planned)
+	}
+	for _, entry := range p.Namespaces {
+		if entry.Namespace == "user-user3" && !strings.Contains(entry.Reason, "idle for 24h0m0s exceeds idle-threshold 12h0m0s") {
+			t.Errorf("Unexpected reason: %s", entry.Reason)
+		}
+	}
+
+	expectedMetrics := `
+	# HELP k8_namespace_reaper_namespace_idle_seconds Time since last activity of namespaces considered for reaping
+	# TYPE k8_namespace_reaper_namespace_idle_seconds gauge
+	k8_namespace_reaper_namespace_idle_seconds{namespace="user-user1"} 3600
+	k8_namespace_reaper_namespace_idle_seconds{namespace="user-user3"} 86400
+	`
+	if err := testutil.GatherAndCompare(metricGathers(), strings.NewReader(expectedMetrics),
+		"k8_namespace_reaper_namespace_idle_seconds"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestRunSafetyChecks(t *testing.T) {
+	queryResults, err := os.ReadFile("testdata/prometheus-query.json")
+	if err != nil {
+		t.Fatalf("Error loading fixture data: %s", err.Error())
+	}
+	emptyResults := []byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`)
+	otherResults := []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"namespace":"kube-system"},"value":[1622841850.868,"1578657600"]}]}}`)
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	timeNow = func() time.Time {
+		return creationTime.Add((time.Hour * 24 * 9))
+	}
+	tests := []struct {
+		name          string
+		args          []string
+		sanityResults []byte
+		queryResults  []byte
+		reason        string
+	}{
+		{name: "empty activity", sanityResults: queryResults, queryResults: emptyResults, reason: "empty_activity"},
+		{name: "activity only for other namespaces", sanityResults: queryResults, queryResults: otherResults, reason: "empty_activity"},
+		{name: "sanity query", sanityResults: emptyResults, queryResults: queryResults, reason: "sanity_query"},
+		{name: "max reap percent", args: []string{"--max-reap-percent=25"}, sanityResults: queryResults, queryResults: queryResults, reason: "max_reap_percent"},
+		{name: "allow empty activity", args: []string{"--allow-empty-activity"}, sanityResults: queryResults, queryResults: emptyResults},
+		{name: "sanity query disabled", args: []string{"--prometheus-sanity-query="}, sanityResults: emptyResults, queryResults: queryResults},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				_ = req.ParseForm()
+				if req.Form.Get("query") == defaultPrometheusSanityQuery {
+					_, _ = rw.Write(test.sanityResults)
+				} else {
+					_, _ = rw.Write(test.queryResults)
+				}
+			}))
+			defer server.Close()
+			args := []string{
+				"--namespace-labels=app.kubernetes.io/name=open-ondemand",
+				fmt.Sprintf("--prometheus-address=%s", server.URL),
+				"--prometheus-retry-timeout=0s",
+				"--dry-run",
+			}
+			if _, err := kingpin.CommandLine.Parse(append(args, test.args...)); err != nil {
+				t.Fatal(err)
+			}
+			var before float64
+			if test.reason != "" {
+				before = testutil.ToFloat64(metricSafetyAbortsTotal.WithLabelValues(test.reason))
+			}
+			err := run(clientset(), nil, logger)
+			if test.reason == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Errorf("Expected error")
+			}
+			if after := testutil.ToFloat64(metricSafetyAbortsTotal.WithLabelValues(test.reason)); after != before+1 {
+				t.Errorf("Expected safety abort metric to increase, got %v", after)
+			}
+		})
+	}
+}
+
 func TestValidateArgs(t *testing.T) {
-	if _, err := kingpin.CommandLine.Parse([]string{}); err == nil {
-		t.Errorf("Expected error parsing lack of args")
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Errorf("Unexpected error parsing lack of args")
+	}
+	if err := validateArgs(promslog.NewNopLogger()); len(err) != 2 {
+		t.Errorf("Expected 2 errors, got %d", len(err))
+	}
+	if _, err := kingpin.CommandLine.Parse([]string{"--activity-source=kubernetes", "--namespace-regexp=user-.+"}); err != nil {
+		t.Errorf("Unexpected error parsing args")
+	}
+	if err := validateArgs(promslog.NewNopLogger()); err != nil {
+		t.Errorf("Unexpected errors: %v", err)
 	}
 	if _, err := kingpin.CommandLine.Parse([]string{"--prometheus-address=foobar"}); err != nil {
 		t.Errorf("Unexpected error parsing args")
@@ -318,6 +1083,20 @@ func TestValidateArgs(t *testing.T) {
 	if err == nil {
 		t.Errorf("Expected error")
 	}
+	args := []string{"--prometheus-address=foobar", "--namespace-regexp=user-.+", "--namespace-exclude-regexp=(", "--namespace-exclude-labels=foo in bar"}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Errorf("Unexpected error parsing args")
+	}
+	err = validateArgs(promslog.NewNopLogger())
+	if len(err) != 2 {
+		t.Errorf("Expected 2 errors, got %d", len(err))
+	}
+	if _, err := kingpin.CommandLine.Parse([]string{"--prometheus-address=foobar", "--namespace-regexp=user-.+", "--idle-threshold=169h"}); err != nil {
+		t.Errorf("Unexpected error parsing args")
+	}
+	if err := validateArgs(promslog.NewNopLogger()); len(err) != 1 {
+		t.Errorf("Expected 1 error, got %d", len(err))
+	}
 }
 
 func TestSetupLogging(t *testing.T) {
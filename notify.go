@@ -0,0 +1,131 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	notifyEventWarned = "warned"
+	notifyEventReaped = "reaped"
+	notifyEventFailed = "failed"
+)
+
+// notifications tracks notifications still being delivered so they can complete before exit
+var notifications sync.WaitGroup
+
+// Notifier delivers notifications about reap decisions
+type Notifier interface {
+	Name() string
+	Enabled(event string) bool
+	Notify(ctx context.Context, n notification) error
+}
+
+// notification describes a reap decision about a namespace, it is also the data passed to notification templates
+type notification struct {
+	Event             string            `json:"event"`
+	Action            string            `json:"action"`
+	Namespace         string            `json:"namespace"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	Annotations       map[string]string `json:"annotations,omitempty"`
+	Idle              time.Duration     `json:"-"`
+	IdleSeconds       float64           `json:"idleSeconds"`
+	LastActivity      *time.Time        `json:"lastActivity,omitempty"`
+	Reason            string            `json:"reason"`
+	ScheduledDeletion *time.Time        `json:"scheduledDeletion,omitempty"`
+	Error             string            `json:"error,omitempty"`
+	Time              time.Time         `json:"time"`
+}
+
+// newNotification builds a notification for a namespace. When there was no activity within reap-after
+// the namespace has been idle for at least that long.
+func newNotification(event string, namespace namespaceCandidate, entry planEntry, now time.Time, err error) notification {
+	idle := namespace.ReapAfter
+	if namespace.LastActivity != nil {
+		idle = now.Sub(*namespace.LastActivity)
+	}
+	n := notification{
+		Event:             event,
+		Action:            *reapAction,
+		Namespace:         namespace.Name,
+		Labels:            namespace.Labels,
+		Annotations:       namespace.Annotations,
+		Idle:              idle,
+		IdleSeconds:       idle.Seconds(),
+		LastActivity:      namespace.LastActivity,
+		Reason:            entry.Reason,
+		ScheduledDeletion: entry.ScheduledDeletion,
+		Time:              now,
+	}
+	if err != nil {
+		n.Error = err.Error()
+	}
+	return n
+}
+
+func getNotifiers(logger *slog.Logger) []Notifier {
+	var notifiers []Notifier
+	if *webhookURL != "" {
+		notifiers = append(notifiers, &webhookNotifier{logger: logger.With("notifier", "webhook")})
+	}
+	if *smtpAddress != "" {
+		notifiers = append(notifiers, &emailNotifier{logger: logger.With("notifier", "email")})
+	}
+	return notifiers
+}
+
+// notify delivers a notification in the background so delivery never blocks or fails reaping
+func notify(notifiers []Notifier, n notification, logger *slog.Logger) {
+	for _, notifier := range notifiers {
+		if !notifier.Enabled(n.Event) {
+			continue
+		}
+		notifications.Add(1)
+		go func(notifier Notifier) {
+			defer notifications.Done()
+			if err := notifier.Notify(context.Background(), n); err != nil {
+				metricNotificationsTotal.WithLabelValues(notifier.Name(), "error").Inc()
+				logger.Error("Error sending notification", "notifier", notifier.Name(), "event", n.Event, "err", err)
+				return
+			}
+			metricNotificationsTotal.WithLabelValues(notifier.Name(), "success").Inc()
+		}(notifier)
+	}
+}
+
+// notifyEnabled returns true if notifications should be sent for an event
+func notifyEnabled(events string, event string) bool {
+	for _, e := range splitList(events) {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma separated flag value, dropping empty items
+func splitList(list string) []string {
+	var result []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
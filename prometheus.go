@@ -0,0 +1,299 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+const (
+	serviceAccountTokenFile      = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	defaultPrometheusSanityQuery = "count(kube_pod_container_info)"
+	defaultPrometheusQuery       = `max(max_over_time(timestamp(kube_pod_container_info{{.Selector}})[{{.Lookback}}:{{.Step}}])) by ({{.NamespaceLabel}})`
+)
+
+// prometheusQueryData holds the variables available to the Prometheus query template
+type prometheusQueryData struct {
+	// Lookback is how far back to look for activity, taken from reap-after
+	Lookback string
+	// Step is the subquery resolution
+	Step string
+	// NamespaceLabel is the label holding the namespace name
+	NamespaceLabel string
+	// NamespaceMatcher matches the namespace regexp, eg namespace=~"user-.+", empty if no regexp is set
+	NamespaceMatcher string
+	// Selector is NamespaceMatcher wrapped in braces, empty if no regexp is set
+	Selector string
+}
+
+// prometheusSource uses pod metrics from kube-state-metrics stored in Prometheus to determine namespace activity
+type prometheusSource struct {
+	logger *slog.Logger
+}
+
+func (p *prometheusSource) Name() string {
+	return "prometheus"
+}
+
+func (p *prometheusSource) LastActivity(ctx context.Context, namespaces []string) (map[string]time.Time, error) {
+	logger := p.logger
+	activity := make(map[string]time.Time)
+	httpConfig, err := prometheusHTTPConfig()
+	if err != nil {
+		logger.Error("Error generating Prometheus client config", "err", err)
+		return nil, err
+	}
+	roundTripper, err := config.NewRoundTripperFromConfig(httpConfig, appName)
+	if err != nil {
+		logger.Error("Error creating Prometheus round tripper", "err", err)
+		return nil, err
+	}
+	client, err := api.NewClient(api.Config{
+		Address:      *prometheusAddress,
+		RoundTripper: roundTripper,
+	})
+	if err != nil {
+		logger.Error("Error creating client", "err", err)
+		return nil, err
+	}
+
+	v1api := v1.NewAPI(client)
+
+	if *prometheusSanityQuery != "" {
+		logger.Debug("Querying Prometheus sanity check", "query", *prometheusSanityQuery)
+		result, err := p.query(ctx, v1api, *prometheusSanityQuery)
+		if err != nil {
+			return nil, err
+		}
+		if !hasData(result) {
+			metricSafetyAbortsTotal.WithLabelValues("sanity_query").Inc()
+			err := fmt.Errorf("prometheus sanity query %q returned no data", *prometheusSanityQuery)
+			logger.Error("Prometheus sanity check failed", "err", err)
+			return nil, err
+		}
+	}
+
+	query, err := prometheusQuery()
+	if err != nil {
+		logger.Error("Error generating Prometheus query", "err", err)
+		return nil, err
+	}
+	logger.Debug("Querying Prometheus", "query", query)
+	result, err := p.query(ctx, v1api, query)
+	if err != nil {
+		return nil, err
+	}
+	if result.Type() == model.ValVector {
+		vector := result.(model.Vector)
+		for _, vec := range vector {
+			if val, ok := vec.Metric[model.LabelName(*prometheusNamespaceLabel)]; ok {
+				activity[string(val)] = sampleTime(vec.Value)
+			}
+		}
+	} else {
+		logger.Error("Unrecognized result type", "type", result.Type())
+		return nil, fmt.Errorf("unrecognized result type %s", result.Type())
+	}
+
+	return activity, nil
+}
+
+// query runs a Prometheus query. Each attempt has its own timeout and retryable errors are retried
+// with exponential backoff and jitter until the retry timeout is reached.
+func (p *prometheusSource) query(ctx context.Context, v1api v1.API, query string) (model.Value, error) {
+	logger := p.logger
+	start := time.Now()
+	retryCtx, cancel := context.WithTimeout(ctx, *prometheusRetryTimeout)
+	defer cancel()
+	// Attempts end when the retry timeout is reached, a retry timeout of 0 only disables retrying
+	attemptParent := retryCtx
+	if *prometheusRetryTimeout <= 0 {
+		attemptParent = ctx
+	}
+	for attempt := 1; ; attempt++ {
+		attemptStart := time.Now()
+		attemptCtx, attemptCancel := context.WithTimeout(attemptParent, *prometheusTimeout)
+		result, warnings, err := v1api.Query(attemptCtx, query, timeNow())
+		attemptCancel()
+		metricPrometheusQueryDuration.Observe(time.Since(attemptStart).Seconds())
+		if err == nil {
+			metricPrometheusQueryAttemptsTotal.WithLabelValues("success").Inc()
+			metricPrometheusQueriesTotal.WithLabelValues("success").Inc()
+			for _, warning := range warnings {
+				logger.Warn("Warning querying Prometheus", "warning", warning)
+			}
+			return result, nil
+		}
+		if !retryablePrometheusError(err) {
+			metricPrometheusQueryAttemptsTotal.WithLabelValues("fatal_error").Inc()
+			metricPrometheusQueriesTotal.WithLabelValues("error").Inc()
+			logger.Error("Error querying Prometheus that can not be retried", "attempt", attempt, "err", err)
+			return nil, err
+		}
+		metricPrometheusQueryAttemptsTotal.WithLabelValues("retryable_error").Inc()
+		backoff := retryBackoff(attempt, *prometheusRetryBackoff, *prometheusRetryMaxBackoff)
+		elapsed := time.Since(start)
+		logger.Error("Error querying Prometheus", "attempt", attempt, "err", err)
+		if retryCtx.Err() == nil {
+			select {
+			case <-retryCtx.Done():
+			case <-time.After(backoff):
+				logger.Info("Retrying Prometheus query", "attempt", attempt+1, "elapsed", elapsed, "backoff", backoff, "timeout", *prometheusRetryTimeout)
+				continue
+			}
+		}
+		metricPrometheusQueriesTotal.WithLabelValues("retry_timeout").Inc()
+		logger.Error("Retry timeout reached", "attempts", attempt, "elapsed", time.Since(start), "timeout", *prometheusRetryTimeout)
+		return nil, err
+	}
+}
+
+// retryBackoff returns the exponential backoff with full jitter to wait before the next attempt
+func retryBackoff(attempt int, initial time.Duration, max time.Duration) time.Duration {
+	backoff := max
+	if attempt < 32 {
+		if exp := initial << (attempt - 1); exp > 0 && exp < backoff {
+			backoff = exp
+		}
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int64N(int64(backoff)) + 1)
+}
+
+// retryablePrometheusError returns false for errors that will not succeed if retried such as bad queries
+func retryablePrometheusError(err error) bool {
+	var apiErr *v1.Error
+	if !errors.As(err, &apiErr) {
+		return true
+	}
+	switch apiErr.Type {
+	case v1.ErrBadData, v1.ErrExec:
+		return false
+	case v1.ErrClient:
+		return strings.HasSuffix(apiErr.Msg, strconv.Itoa(http.StatusTooManyRequests)) ||
+			strings.HasSuffix(apiErr.Msg, strconv.Itoa(http.StatusRequestTimeout))
+	}
+	return true
+}
+
+// hasData returns true if a query result contains at least one non-zero sample
+func hasData(result model.Value) bool {
+	switch v := result.(type) {
+	case model.Vector:
+		for _, sample := range v {
+			if sample.Value != 0 {
+				return true
+			}
+		}
+	case *model.Scalar:
+		return v.Value != 0
+	case model.Matrix:
+		for _, stream := range v {
+			for _, sample := range stream.Values {
+				if sample.Value != 0 {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// prometheusHTTPConfig returns the HTTP client configuration used to connect to Prometheus
+func prometheusHTTPConfig() (config.HTTPClientConfig, error) {
+	httpConfig := config.DefaultHTTPClientConfig
+	httpConfig.BearerToken = config.Secret(*prometheusBearerToken)
+	httpConfig.BearerTokenFile = *prometheusBearerTokenFile
+	if *prometheusInClusterToken {
+		if httpConfig.BearerTokenFile != "" {
+			return httpConfig, errors.New("prometheus bearer token file can not be used with in cluster token")
+		}
+		httpConfig.BearerTokenFile = serviceAccountTokenFile
+	}
+	if *prometheusUsername != "" || *prometheusPassword != "" || *prometheusPasswordFile != "" {
+		httpConfig.BasicAuth = &config.BasicAuth{
+			Username:     *prometheusUsername,
+			Password:     config.Secret(*prometheusPassword),
+			PasswordFile: *prometheusPasswordFile,
+		}
+	}
+	httpConfig.TLSConfig = config.TLSConfig{
+		CAFile:     *prometheusCAFile,
+		CertFile:   *prometheusCertFile,
+		KeyFile:    *prometheusKeyFile,
+		ServerName: *prometheusServerName,
+	}
+	if err := httpConfig.TLSConfig.Validate(); err != nil {
+		return httpConfig, fmt.Errorf("invalid prometheus TLS configuration: %w", err)
+	}
+	if len(*prometheusHeaders) > 0 {
+		httpConfig.HTTPHeaders = &config.Headers{Headers: make(map[string]config.Header)}
+		for name, value := range *prometheusHeaders {
+			httpConfig.HTTPHeaders.Headers[name] = config.Header{Secrets: []config.Secret{config.Secret(value)}}
+		}
+	}
+	if err := httpConfig.Validate(); err != nil {
+		return httpConfig, fmt.Errorf("invalid prometheus client configuration: %w", err)
+	}
+	return httpConfig, nil
+}
+
+// prometheusQuery renders the Prometheus query template and validates the result is PromQL
+func prometheusQuery() (string, error) {
+	tmpl, err := template.New("query").Option("missingkey=error").Parse(*prometheusQueryTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid prometheus query template: %w", err)
+	}
+	data := prometheusQueryData{
+		Lookback:       model.Duration(*reapAfter).String(),
+		Step:           model.Duration(*prometheusQueryStep).String(),
+		NamespaceLabel: *prometheusNamespaceLabel,
+	}
+	if *namespaceRegexp != "" {
+		data.NamespaceMatcher = fmt.Sprintf("%s=~%q", *prometheusNamespaceLabel, *namespaceRegexp)
+		data.Selector = fmt.Sprintf("{%s}", data.NamespaceMatcher)
+	}
+	var query strings.Builder
+	if err := tmpl.Execute(&query, data); err != nil {
+		return "", fmt.Errorf("error executing prometheus query template: %w", err)
+	}
+	if _, err := parser.ParseExpr(query.String()); err != nil {
+		return "", fmt.Errorf("invalid prometheus query %q: %w", query.String(), err)
+	}
+	return query.String(), nil
+}
+
+// sampleTime converts a sample value holding a Unix timestamp in seconds to a time
+func sampleTime(value model.SampleValue) time.Time {
+	sec, frac := math.Modf(float64(value))
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
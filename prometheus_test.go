@@ -0,0 +1,409 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPrometheusLastActivity(t *testing.T) {
+	queryResults, err := os.ReadFile("testdata/prometheus-query.json")
+	if err != nil {
+		t.Fatalf("Error loading fixture data: %s", err.Error())
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write(queryResults)
+	}))
+	defer server.Close()
+	address, _ := url.Parse(server.URL)
+	args := []string{fmt.Sprintf("--prometheus-address=%s", address)}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	source := &prometheusSource{logger: logger}
+	activity, err := source.LastActivity(context.Background(), nil)
+	if err != nil {
+		t.Errorf("Unexpected error %s", err.Error())
+		return
+	}
+	var activeNamespaces []string
+	for namespace := range activity {
+		activeNamespaces = append(activeNamespaces, namespace)
+	}
+	if len(activeNamespaces) != 2 {
+		t.Errorf("Unexpected number activeNamespaces, got %d", len(activeNamespaces))
+		return
+	}
+	expectedActiveNamespaces := []string{"user-user1", "user-user3"}
+	sort.Strings(activeNamespaces)
+	sort.Strings(expectedActiveNamespaces)
+	if !reflect.DeepEqual(activeNamespaces, expectedActiveNamespaces) {
+		t.Errorf("Unexpected value for active namespaces\nExpected %v\nGot %v\n", expectedActiveNamespaces, activeNamespaces)
+	}
+}
+
+func TestPrometheusQuery(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{
+			args:     []string{},
+			expected: `max(max_over_time(timestamp(kube_pod_container_info)[1w:5m])) by (namespace)`,
+		},
+		{
+			args:     []string{"--namespace-regexp=user-.+", "--reap-after=36h"},
+			expected: `max(max_over_time(timestamp(kube_pod_container_info{namespace=~"user-.+"})[1d12h:5m])) by (namespace)`,
+		},
+		{
+			args: []string{
+				"--namespace-regexp=user-.+",
+				"--prometheus-namespace-label=exported_namespace",
+				"--prometheus-query-step=1m",
+				`--prometheus-query=max(max_over_time(timestamp(kube_pod_info{cluster="prod"{{with .NamespaceMatcher}},{{.}}{{end}}})[{{.Lookback}}:{{.Step}}])) by ({{.NamespaceLabel}})`,
+			},
+			expected: `max(max_over_time(timestamp(kube_pod_info{cluster="prod",exported_namespace=~"user-.+"})[1w:1m])) by (exported_namespace)`,
+		},
+	}
+	for _, test := range tests {
+		args := append([]string{"--prometheus-address=foobar"}, test.args...)
+		if _, err := kingpin.CommandLine.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		query, err := prometheusQuery()
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+			continue
+		}
+		if query != test.expected {
+			t.Errorf("Unexpected query\nExpected: %s\nGot: %s", test.expected, query)
+		}
+	}
+	for _, query := range []string{"max(kube_pod_info{{.Foo}})", "max(kube_pod_info{{", "max(kube_pod_info"} {
+		if _, err := kingpin.CommandLine.Parse([]string{"--prometheus-address=foobar", "--prometheus-query=" + query}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := prometheusQuery(); err == nil {
+			t.Errorf("Expected error for query %s", query)
+		}
+	}
+}
+
+func TestPrometheusLastActivityNamespaceLabel(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_ = req.ParseForm()
+		query = req.Form.Get("query")
+		_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"exported_namespace":"user-user1"},"value":[1622841850.868,"1578510000.5"]}]}}`))
+	}))
+	defer server.Close()
+	args := []string{
+		fmt.Sprintf("--prometheus-address=%s", server.URL),
+		"--prometheus-namespace-label=exported_namespace",
+	}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	source := &prometheusSource{logger: logger}
+	activity, err := source.LastActivity(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if query != `max(max_over_time(timestamp(kube_pod_container_info)[1w:5m])) by (exported_namespace)` {
+		t.Errorf("Unexpected query: %s", query)
+	}
+	expected := map[string]time.Time{"user-user1": time.Unix(1578510000, 500000000)}
+	if !reflect.DeepEqual(activity, expected) {
+		t.Errorf("Unexpected activity\nExpected: %v\nGot: %v", expected, activity)
+	}
+}
+
+func TestPrometheusLastActivityAuth(t *testing.T) {
+	queryResults, err := os.ReadFile("testdata/prometheus-query.json")
+	if err != nil {
+		t.Fatalf("Error loading fixture data: %s", err.Error())
+	}
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		args   []string
+		header string
+		value  string
+	}{
+		{name: "bearer", args: []string{"--prometheus-bearer-token=secret"}, header: "Authorization", value: "Bearer secret"},
+		{name: "bearer file", args: []string{"--prometheus-bearer-token-file=" + tokenFile}, header: "Authorization", value: "Bearer file-token"},
+		{name: "basic", args: []string{"--prometheus-username=user", "--prometheus-password=pass"}, header: "Authorization", value: "Basic dXNlcjpwYXNz"},
+		{name: "header", args: []string{"--prometheus-header=X-Scope-OrgID=tenant"}, header: "X-Scope-OrgID", value: "tenant"},
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got string
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				got = req.Header.Get(test.header)
+				_, _ = rw.Write(queryResults)
+			}))
+			defer server.Close()
+			*prometheusHeaders = map[string]string{}
+			args := append([]string{fmt.Sprintf("--prometheus-address=%s", server.URL)}, test.args...)
+			if _, err := kingpin.CommandLine.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { *prometheusHeaders = map[string]string{} }()
+			source := &prometheusSource{logger: logger}
+			if _, err := source.LastActivity(context.Background(), nil); err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if got != test.value {
+				t.Errorf("Unexpected %s header, expected %q got %q", test.header, test.value, got)
+			}
+		})
+	}
+}
+
+func TestPrometheusLastActivityTLS(t *testing.T) {
+	queryResults, err := os.ReadFile("testdata/prometheus-query.json")
+	if err != nil {
+		t.Fatalf("Error loading fixture data: %s", err.Error())
+	}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write(queryResults)
+	}))
+	defer server.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	tests := []struct {
+		name      string
+		args      []string
+		expectErr bool
+	}{
+		{name: "untrusted", args: []string{}, expectErr: true},
+		{name: "ca", args: []string{"--prometheus-ca-file=" + caFile}},
+		{name: "server name", args: []string{"--prometheus-ca-file=" + caFile, "--prometheus-server-name=example.com"}},
+		{name: "wrong server name", args: []string{"--prometheus-ca-file=" + caFile, "--prometheus-server-name=prometheus.example.org"}, expectErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := append([]string{fmt.Sprintf("--prometheus-address=%s", server.URL), "--prometheus-retry-timeout=0s"}, test.args...)
+			if _, err := kingpin.CommandLine.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+			source := &prometheusSource{logger: logger}
+			_, err := source.LastActivity(context.Background(), nil)
+			if test.expectErr && err == nil {
+				t.Errorf("Expected error")
+			} else if !test.expectErr && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestPrometheusHTTPConfig(t *testing.T) {
+	invalid := [][]string{
+		{"--prometheus-bearer-token=foo", "--prometheus-username=user"},
+		{"--prometheus-bearer-token=foo", "--prometheus-bearer-token-file=/token"},
+		{"--prometheus-bearer-token-file=/token", "--prometheus-in-cluster-token"},
+		{"--prometheus-cert-file=/cert.pem"},
+		{"--prometheus-header=Authorization=foo"},
+	}
+	for _, args := range invalid {
+		*prometheusHeaders = map[string]string{}
+		if _, err := kingpin.CommandLine.Parse(append([]string{"--prometheus-address=foobar"}, args...)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := prometheusHTTPConfig(); err == nil {
+			t.Errorf("Expected error for args %v", args)
+		}
+	}
+	*prometheusHeaders = map[string]string{}
+	if _, err := kingpin.CommandLine.Parse([]string{"--prometheus-address=foobar", "--prometheus-in-cluster-token"}); err != nil {
+		t.Fatal(err)
+	}
+	httpConfig, err := prometheusHTTPConfig()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if httpConfig.Authorization == nil || httpConfig.Authorization.CredentialsFile != serviceAccountTokenFile {
+		t.Errorf("Expected in cluster token file, got %+v", httpConfig.Authorization)
+	}
+}
+
+func TestPrometheusQueryRetry(t *testing.T) {
+	queryResults, err := os.ReadFile("testdata/prometheus-query.json")
+	if err != nil {
+		t.Fatalf("Error loading fixture data: %s", err.Error())
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	tests := []struct {
+		name      string
+		args      []string
+		handler   func(attempt int32, rw http.ResponseWriter, req *http.Request)
+		attempts  int32
+		outcome   string
+		expectErr bool
+		// maxElapsed is how long the query may take when set
+		maxElapsed time.Duration
+	}{
+		{
+			name: "flaky",
+			handler: func(attempt int32, rw http.ResponseWriter, req *http.Request) {
+				if attempt <= 2 {
+					rw.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				_, _ = rw.Write(queryResults)
+			},
+			attempts: 3,
+			outcome:  "success",
+		},
+		{
+			name: "slow attempt",
+			args: []string{"--prometheus-timeout=50ms"},
+			handler: func(attempt int32, rw http.ResponseWriter, req *http.Request) {
+				if attempt == 1 {
+					time.Sleep(200 * time.Millisecond)
+				}
+				_, _ = rw.Write(queryResults)
+			},
+			attempts: 2,
+			outcome:  "success",
+		},
+		{
+			name: "bad query",
+			handler: func(attempt int32, rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(http.StatusBadRequest)
+				_, _ = rw.Write([]byte(`{"status":"error","errorType":"bad_data","error":"parse error"}`))
+			},
+			attempts:  1,
+			outcome:   "error",
+			expectErr: true,
+		},
+		{
+			name: "forbidden",
+			handler: func(attempt int32, rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(http.StatusForbidden)
+			},
+			attempts:  1,
+			outcome:   "error",
+			expectErr: true,
+		},
+		{
+			name: "retry timeout",
+			args: []string{"--prometheus-retry-timeout=100ms"},
+			handler: func(attempt int32, rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(http.StatusBadGateway)
+			},
+			outcome:   "retry_timeout",
+			expectErr: true,
+		},
+		{
+			name: "attempt longer than retry timeout",
+			args: []string{"--prometheus-timeout=5s", "--prometheus-retry-timeout=100ms"},
+			handler: func(attempt int32, rw http.ResponseWriter, req *http.Request) {
+				// Reading the request lets the server notice when the client gives up
+				_, _ = io.Copy(io.Discard, req.Body)
+				select {
+				case <-req.Context().Done():
+				case <-time.After(5 * time.Second):
+				}
+				rw.WriteHeader(http.StatusBadGateway)
+			},
+			attempts:   1,
+			outcome:    "retry_timeout",
+			expectErr:  true,
+			maxElapsed: time.Second,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				test.handler(attempts.Add(1), rw, req)
+			}))
+			defer server.Close()
+			args := []string{
+				fmt.Sprintf("--prometheus-address=%s", server.URL),
+				"--prometheus-sanity-query=",
+				"--prometheus-retry-backoff=1ms",
+				"--prometheus-retry-max-backoff=10ms",
+			}
+			if _, err := kingpin.CommandLine.Parse(append(args, test.args...)); err != nil {
+				t.Fatal(err)
+			}
+			before := testutil.ToFloat64(metricPrometheusQueriesTotal.WithLabelValues(test.outcome))
+			source := &prometheusSource{logger: logger}
+			start := time.Now()
+			_, err := source.LastActivity(context.Background(), nil)
+			if elapsed := time.Since(start); test.maxElapsed != 0 && elapsed > test.maxElapsed {
+				t.Errorf("Query took %s, expected at most %s", elapsed, test.maxElapsed)
+			}
+			if test.expectErr && err == nil {
+				t.Errorf("Expected error")
+			} else if !test.expectErr && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if test.attempts != 0 && attempts.Load() != test.attempts {
+				t.Errorf("Unexpected number of attempts, expected %d got %d", test.attempts, attempts.Load())
+			}
+			if test.attempts == 0 && attempts.Load() < 2 {
+				t.Errorf("Expected multiple attempts, got %d", attempts.Load())
+			}
+			if after := testutil.ToFloat64(metricPrometheusQueriesTotal.WithLabelValues(test.outcome)); after != before+1 {
+				t.Errorf("Expected %s outcome metric to increase, got %v", test.outcome, after)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--prometheus-retry-backoff=1s", "--prometheus-retry-max-backoff=30s"}); err != nil {
+		t.Fatal(err)
+	}
+	for attempt, limit := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 6: 30 * time.Second, 100: 30 * time.Second} {
+		for i := 0; i < 10; i++ {
+			if backoff := retryBackoff(attempt, *prometheusRetryBackoff, *prometheusRetryMaxBackoff); backoff <= 0 || backoff > limit {
+				t.Errorf("Unexpected backoff for attempt %d: %v", attempt, backoff)
+			}
+		}
+	}
+}
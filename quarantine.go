@@ -0,0 +1,328 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	quarantineLabel        = "k8-namespace-reaper.osc.edu/quarantined"
+	quarantineAnnotation   = "k8-namespace-reaper.osc.edu/quarantine"
+	releasedAnnotation     = "k8-namespace-reaper.osc.edu/released"
+	quarantineResourceName = "k8-namespace-reaper-quarantine"
+	eventReasonQuarantined = "Quarantined"
+	eventReasonReleased    = "Released"
+)
+
+// quarantineState records what quarantining a namespace changed so releasing it can undo exactly those changes
+type quarantineState struct {
+	Time          time.Time        `json:"time"`
+	ResourceQuota string           `json:"resourceQuota,omitempty"`
+	NetworkPolicy string           `json:"networkPolicy,omitempty"`
+	Deployments   map[string]int32 `json:"deployments,omitempty"`
+	StatefulSets  map[string]int32 `json:"statefulSets,omitempty"`
+	CronJobs      []string         `json:"cronJobs,omitempty"`
+}
+
+// namespaceQuarantiner stops a namespace from using resources without deleting any of its data
+type namespaceQuarantiner struct{}
+
+func (namespaceQuarantiner) Name() string {
+	return reapActionQuarantine
+}
+
+// Apply marks the namespace as quarantined then prevents new pods, scales workloads to zero, suspends CronJobs
+// and denies all network traffic. What was changed is recorded on the namespace even when a step fails.
+func (namespaceQuarantiner) Apply(ctx context.Context, clientset kubernetes.Interface, namespace namespaceCandidate) error {
+	state := quarantineState{Time: timeNow().UTC()}
+	// Preconditions ensure a namespace recreated with the same name or changed since it was evaluated is not quarantined
+	if err := patchQuarantine(ctx, clientset, namespace.Name, map[string]any{
+		"uid":             namespace.UID,
+		"resourceVersion": namespace.ResourceVersion,
+		"labels":          map[string]any{quarantineLabel: "true"},
+		"annotations":     map[string]any{quarantineAnnotation: quarantineAnnotationValue(state), *scheduledAnnotation: nil, releasedAnnotation: nil},
+	}); err != nil {
+		return err
+	}
+	err := quarantineNamespace(ctx, clientset, namespace.Name, &state)
+	if patchErr := patchQuarantine(ctx, clientset, namespace.Name, map[string]any{
+		"annotations": map[string]any{quarantineAnnotation: quarantineAnnotationValue(state)},
+	}); patchErr != nil {
+		err = errors.Join(err, fmt.Errorf("error recording quarantine: %w", patchErr))
+	}
+	if err != nil {
+		return err
+	}
+	namespaceEvent(namespace.Name, namespace.UID, corev1.EventTypeWarning, eventReasonQuarantined,
+		"Namespace is idle and has been quarantined, workloads were scaled to zero and network traffic is denied")
+	return nil
+}
+
+func quarantineNamespace(ctx context.Context, clientset kubernetes.Interface, namespace string, state *quarantineState) error {
+	quota := &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: quarantineResourceName, Namespace: namespace},
+		Spec: corev1.ResourceQuotaSpec{
+			Hard: corev1.ResourceList{corev1.ResourcePods: resource.MustParse("0")},
+		},
+	}
+	if _, err := clientset.CoreV1().ResourceQuotas(namespace).Create(ctx, quota, metav1.CreateOptions{}); err == nil {
+		state.ResourceQuota = quota.Name
+	} else if !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("error creating resource quota: %w", err)
+	}
+
+	policy := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: quarantineResourceName, Namespace: namespace},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress},
+		},
+	}
+	if _, err := clientset.NetworkingV1().NetworkPolicies(namespace).Create(ctx, policy, metav1.CreateOptions{}); err == nil {
+		state.NetworkPolicy = policy.Name
+	} else if !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("error creating network policy: %w", err)
+	}
+
+	scaleToZero := []byte(`{"spec":{"replicas":0}}`)
+	deployments, err := clientset.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error listing deployments: %w", err)
+	}
+	for _, deployment := range deployments.Items {
+		replicas := replicasOrDefault(deployment.Spec.Replicas)
+		if replicas == 0 {
+			continue
+		}
+		if _, err := clientset.AppsV1().Deployments(namespace).Patch(ctx, deployment.Name, types.MergePatchType, scaleToZero, metav1.PatchOptions{}); err != nil {
+			return fmt.Errorf("error scaling deployment %s: %w", deployment.Name, err)
+		}
+		if state.Deployments == nil {
+			state.Deployments = make(map[string]int32)
+		}
+		state.Deployments[deployment.Name] = replicas
+	}
+	statefulSets, err := clientset.AppsV1().StatefulSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error listing statefulsets: %w", err)
+	}
+	for _, statefulSet := range statefulSets.Items {
+		replicas := replicasOrDefault(statefulSet.Spec.Replicas)
+		if replicas == 0 {
+			continue
+		}
+		if _, err := clientset.AppsV1().StatefulSets(namespace).Patch(ctx, statefulSet.Name, types.MergePatchType, scaleToZero, metav1.PatchOptions{}); err != nil {
+			return fmt.Errorf("error scaling statefulset %s: %w", statefulSet.Name, err)
+		}
+		if state.StatefulSets == nil {
+			state.StatefulSets = make(map[string]int32)
+		}
+		state.StatefulSets[statefulSet.Name] = replicas
+	}
+
+	cronJobs, err := clientset.BatchV1().CronJobs(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error listing cronjobs: %w", err)
+	}
+	for _, cronJob := range cronJobs.Items {
+		if cronJob.Spec.Suspend != nil && *cronJob.Spec.Suspend {
+			continue
+		}
+		if _, err := clientset.BatchV1().CronJobs(namespace).Patch(ctx, cronJob.Name, types.MergePatchType, []byte(`{"spec":{"suspend":true}}`), metav1.PatchOptions{}); err != nil {
+			return fmt.Errorf("error suspending cronjob %s: %w", cronJob.Name, err)
+		}
+		state.CronJobs = append(state.CronJobs, cronJob.Name)
+	}
+	return nil
+}
+
+// release undoes the changes made when a namespace was quarantined. Workloads are only scaled back up and CronJobs
+// only resumed if they were not changed while quarantined.
+func release(clientset kubernetes.Interface, logger *slog.Logger) error {
+	ctx := context.TODO()
+	logger = logger.With("namespace", *releaseNamespace)
+	namespace, err := clientset.CoreV1().Namespaces().Get(ctx, *releaseNamespace, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	value, ok := namespace.Annotations[quarantineAnnotation]
+	if !ok {
+		return errors.New("namespace is not quarantined")
+	}
+	var state quarantineState
+	if err := json.Unmarshal([]byte(value), &state); err != nil {
+		return fmt.Errorf("error parsing quarantine annotation: %w", err)
+	}
+
+	errCount := 0
+	for _, name := range state.CronJobs {
+		cronJob, err := clientset.BatchV1().CronJobs(namespace.Name).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			errCount++
+			logger.Error("Error getting cronjob", "cronjob", name, "err", err)
+			continue
+		}
+		if cronJob.Spec.Suspend == nil || !*cronJob.Spec.Suspend {
+			continue
+		}
+		if *dryRun {
+			logger.Info("Dry run, would resume cronjob", "cronjob", name)
+			continue
+		}
+		if _, err := clientset.BatchV1().CronJobs(namespace.Name).Patch(ctx, name, types.MergePatchType, []byte(`{"spec":{"suspend":false}}`), metav1.PatchOptions{}); err != nil {
+			errCount++
+			logger.Error("Error resuming cronjob", "cronjob", name, "err", err)
+			continue
+		}
+		logger.Info("Resumed cronjob", "cronjob", name)
+	}
+	for name, replicas := range state.Deployments {
+		deployment, err := clientset.AppsV1().Deployments(namespace.Name).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			errCount++
+			logger.Error("Error getting deployment", "deployment", name, "err", err)
+			continue
+		}
+		if replicasOrDefault(deployment.Spec.Replicas) != 0 {
+			continue
+		}
+		if *dryRun {
+			logger.Info("Dry run, would scale deployment", "deployment", name, "replicas", replicas)
+			continue
+		}
+		if _, err := clientset.AppsV1().Deployments(namespace.Name).Patch(ctx, name, types.MergePatchType, replicasPatch(replicas), metav1.PatchOptions{}); err != nil {
+			errCount++
+			logger.Error("Error scaling deployment", "deployment", name, "err", err)
+			continue
+		}
+		logger.Info("Scaled deployment", "deployment", name, "replicas", replicas)
+	}
+	for name, replicas := range state.StatefulSets {
+		statefulSet, err := clientset.AppsV1().StatefulSets(namespace.Name).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			errCount++
+			logger.Error("Error getting statefulset", "statefulset", name, "err", err)
+			continue
+		}
+		if replicasOrDefault(statefulSet.Spec.Replicas) != 0 {
+			continue
+		}
+		if *dryRun {
+			logger.Info("Dry run, would scale statefulset", "statefulset", name, "replicas", replicas)
+			continue
+		}
+		if _, err := clientset.AppsV1().StatefulSets(namespace.Name).Patch(ctx, name, types.MergePatchType, replicasPatch(replicas), metav1.PatchOptions{}); err != nil {
+			errCount++
+			logger.Error("Error scaling statefulset", "statefulset", name, "err", err)
+			continue
+		}
+		logger.Info("Scaled statefulset", "statefulset", name, "replicas", replicas)
+	}
+	if state.NetworkPolicy != "" {
+		if *dryRun {
+			logger.Info("Dry run, would delete network policy", "networkpolicy", state.NetworkPolicy)
+		} else if err := clientset.NetworkingV1().NetworkPolicies(namespace.Name).Delete(ctx, state.NetworkPolicy, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			errCount++
+			logger.Error("Error deleting network policy", "networkpolicy", state.NetworkPolicy, "err", err)
+		}
+	}
+	if state.ResourceQuota != "" {
+		if *dryRun {
+			logger.Info("Dry run, would delete resource quota", "resourcequota", state.ResourceQuota)
+		} else if err := clientset.CoreV1().ResourceQuotas(namespace.Name).Delete(ctx, state.ResourceQuota, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			errCount++
+			logger.Error("Error deleting resource quota", "resourcequota", state.ResourceQuota, "err", err)
+		}
+	}
+	if errCount > 0 {
+		// The namespace stays marked as quarantined so release can be run again
+		return fmt.Errorf("%d errors releasing namespace", errCount)
+	}
+	if *dryRun {
+		logger.Info("Dry run, would release namespace")
+		return nil
+	}
+	if err := patchQuarantine(ctx, clientset, namespace.Name, map[string]any{
+		"labels":      map[string]any{quarantineLabel: nil},
+		"annotations": map[string]any{quarantineAnnotation: nil, *scheduledAnnotation: nil, releasedAnnotation: timeNow().UTC().Format(time.RFC3339)},
+	}); err != nil {
+		return fmt.Errorf("error removing quarantine from namespace: %w", err)
+	}
+	namespaceEvent(namespace.Name, namespace.UID, corev1.EventTypeNormal, eventReasonReleased, "Namespace has been released from quarantine")
+	logger.Info("Released namespace from quarantine")
+	return nil
+}
+
+// recentlyReleased returns when a namespace was released from quarantine if it is within the release protection,
+// otherwise a namespace that is still idle would be quarantined again by the next run
+func recentlyReleased(namespace corev1.Namespace) (time.Time, bool) {
+	val, ok := namespace.Annotations[releasedAnnotation]
+	if !ok || *releaseProtection <= 0 {
+		return time.Time{}, false
+	}
+	released, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return released, timeNow().Before(released.Add(*releaseProtection))
+}
+
+func patchQuarantine(ctx context.Context, clientset kubernetes.Interface, namespace string, metadata map[string]any) error {
+	patch, err := json.Marshal(map[string]any{"metadata": metadata})
+	if err != nil {
+		return err
+	}
+	_, err = clientset.CoreV1().Namespaces().Patch(ctx, namespace, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+func quarantineAnnotationValue(state quarantineState) string {
+	value, _ := json.Marshal(state)
+	return string(value)
+}
+
+func replicasPatch(replicas int32) []byte {
+	return []byte(fmt.Sprintf(`{"spec":{"replicas":%d}}`, replicas))
+}
+
+// replicasOrDefault returns the desired replicas of a workload, which the API server defaults to 1 when unset
+func replicasOrDefault(replicas *int32) int32 {
+	if replicas == nil {
+		return 1
+	}
+	return *replicas
+}
@@ -0,0 +1,208 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func quarantineObjects() []runtime.Object {
+	replicas := func(r int32) *int32 {
+		return &r
+	}
+	suspend := true
+	return []runtime.Object{
+		verifyFixture(map[string]string{"k8-namespace-reaper.osc.edu/scheduled-deletion": "2020-01-08T13:00:00Z"}, "1"),
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "user-user2"},
+			Spec:       appsv1.DeploymentSpec{Replicas: replicas(3)},
+		},
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "stopped", Namespace: "user-user2"},
+			Spec:       appsv1.DeploymentSpec{Replicas: replicas(0)},
+		},
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "user-user2"},
+		},
+		&batchv1.CronJob{
+			ObjectMeta: metav1.ObjectMeta{Name: "backup", Namespace: "user-user2"},
+		},
+		&batchv1.CronJob{
+			ObjectMeta: metav1.ObjectMeta{Name: "paused", Namespace: "user-user2"},
+			Spec:       batchv1.CronJobSpec{Suspend: &suspend},
+		},
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--reap-action=quarantine"}); err != nil {
+		t.Fatal(err)
+	}
+	timeNow = func() time.Time {
+		return creationTime.Add((time.Hour * 24 * 9))
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	candidate := namespaceCandidate{Name: "user-user2", UID: "uid-1", ResourceVersion: "1", Age: time.Hour * 200, ReapAfter: time.Hour * 168}
+	clientset := fake.NewSimpleClientset(quarantineObjects()...)
+
+	if errCount := reap([]namespaceCandidate{candidate}, clientset, nil, getNamespaceAction(), nil, nil, logger); errCount != 0 {
+		t.Errorf("Unexpected error count: %d", errCount)
+	}
+	if p := lastPlan.get(); p.ReapAction != reapActionQuarantine || len(p.Namespaces) != 1 || !p.Namespaces[0].Reaped {
+		t.Errorf("Unexpected plan: %+v", p)
+	}
+	ctx := context.TODO()
+	namespace, err := clientset.CoreV1().Namespaces().Get(ctx, "user-user2", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Namespace was deleted: %v", err)
+	}
+	if namespace.Labels[quarantineLabel] != "true" {
+		t.Errorf("Namespace not labeled as quarantined: %v", namespace.Labels)
+	}
+	if _, ok := namespace.Annotations["k8-namespace-reaper.osc.edu/scheduled-deletion"]; ok {
+		t.Errorf("Scheduled deletion not cleared")
+	}
+	var state quarantineState
+	if err := json.Unmarshal([]byte(namespace.Annotations[quarantineAnnotation]), &state); err != nil {
+		t.Fatalf("Unexpected error parsing quarantine annotation: %v", err)
+	}
+	if state.ResourceQuota != quarantineResourceName || state.NetworkPolicy != quarantineResourceName {
+		t.Errorf("Unexpected quarantine state: %+v", state)
+	}
+	if len(state.Deployments) != 1 || state.Deployments["web"] != 3 {
+		t.Errorf("Unexpected quarantined deployments: %v", state.Deployments)
+	}
+	if len(state.StatefulSets) != 1 || state.StatefulSets["db"] != 1 {
+		t.Errorf("Unexpected quarantined statefulsets: %v", state.StatefulSets)
+	}
+	if len(state.CronJobs) != 1 || state.CronJobs[0] != "backup" {
+		t.Errorf("Unexpected quarantined cronjobs: %v", state.CronJobs)
+	}
+	quota, err := clientset.CoreV1().ResourceQuotas("user-user2").Get(ctx, quarantineResourceName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Resource quota not created: %v", err)
+	}
+	if pods := quota.Spec.Hard[v1.ResourcePods]; !pods.IsZero() {
+		t.Errorf("Unexpected pod quota: %v", pods.String())
+	}
+	policy, err := clientset.NetworkingV1().NetworkPolicies("user-user2").Get(ctx, quarantineResourceName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Network policy not created: %v", err)
+	}
+	if len(policy.Spec.PolicyTypes) != 2 || len(policy.Spec.Ingress) != 0 || len(policy.Spec.Egress) != 0 {
+		t.Errorf("Network policy does not deny all traffic: %+v", policy.Spec)
+	}
+	if r := deploymentReplicas(t, clientset, "web"); r != 0 {
+		t.Errorf("Deployment not scaled to zero: %d", r)
+	}
+	statefulSet, _ := clientset.AppsV1().StatefulSets("user-user2").Get(ctx, "db", metav1.GetOptions{})
+	if statefulSet.Spec.Replicas == nil || *statefulSet.Spec.Replicas != 0 {
+		t.Errorf("StatefulSet not scaled to zero: %v", statefulSet.Spec.Replicas)
+	}
+	cronJob, _ := clientset.BatchV1().CronJobs("user-user2").Get(ctx, "backup", metav1.GetOptions{})
+	if cronJob.Spec.Suspend == nil || !*cronJob.Spec.Suspend {
+		t.Errorf("CronJob not suspended")
+	}
+	if _, ok := evaluateNamespace(*namespace, labels.Nothing(), logger); ok {
+		t.Errorf("Quarantined namespace is a reap candidate")
+	}
+
+	if _, err := kingpin.CommandLine.Parse([]string{"release", "user-user2"}); err != nil {
+		t.Fatal(err)
+	}
+	eventRecorder = newSyncEventRecorder(clientset, logger)
+	defer func() { eventRecorder = &record.FakeRecorder{} }()
+	if err := release(clientset, logger); err != nil {
+		t.Fatalf("Unexpected error releasing namespace: %v", err)
+	}
+	events, err := clientset.CoreV1().Events("user-user2").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events.Items) != 1 || events.Items[0].Reason != eventReasonReleased {
+		t.Errorf("Unexpected events after release: %v", events.Items)
+	}
+	namespace, _ = clientset.CoreV1().Namespaces().Get(ctx, "user-user2", metav1.GetOptions{})
+	if _, ok := namespace.Labels[quarantineLabel]; ok {
+		t.Errorf("Quarantine label not removed")
+	}
+	if _, ok := namespace.Annotations[quarantineAnnotation]; ok {
+		t.Errorf("Quarantine annotation not removed")
+	}
+	if _, err := clientset.CoreV1().ResourceQuotas("user-user2").Get(ctx, quarantineResourceName, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Resource quota not deleted: %v", err)
+	}
+	if _, err := clientset.NetworkingV1().NetworkPolicies("user-user2").Get(ctx, quarantineResourceName, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Network policy not deleted: %v", err)
+	}
+	if r := deploymentReplicas(t, clientset, "web"); r != 3 {
+		t.Errorf("Deployment not scaled back up: %d", r)
+	}
+	if r := deploymentReplicas(t, clientset, "stopped"); r != 0 {
+		t.Errorf("Deployment that was not quarantined was scaled: %d", r)
+	}
+	statefulSet, _ = clientset.AppsV1().StatefulSets("user-user2").Get(ctx, "db", metav1.GetOptions{})
+	if statefulSet.Spec.Replicas == nil || *statefulSet.Spec.Replicas != 1 {
+		t.Errorf("StatefulSet not scaled back up: %v", statefulSet.Spec.Replicas)
+	}
+	cronJob, _ = clientset.BatchV1().CronJobs("user-user2").Get(ctx, "backup", metav1.GetOptions{})
+	if cronJob.Spec.Suspend == nil || *cronJob.Spec.Suspend {
+		t.Errorf("CronJob not resumed")
+	}
+	cronJob, _ = clientset.BatchV1().CronJobs("user-user2").Get(ctx, "paused", metav1.GetOptions{})
+	if cronJob.Spec.Suspend == nil || !*cronJob.Spec.Suspend {
+		t.Errorf("CronJob suspended before quarantine was resumed")
+	}
+	if released := namespace.Annotations[releasedAnnotation]; released != "2020-01-10T13:00:00Z" {
+		t.Errorf("Unexpected released annotation: %s", released)
+	}
+	if _, ok := evaluateNamespace(*namespace, labels.Nothing(), logger); ok {
+		t.Errorf("Recently released namespace is a reap candidate")
+	}
+	timeNow = func() time.Time {
+		return creationTime.Add((time.Hour * 24 * 17))
+	}
+	if _, ok := evaluateNamespace(*namespace, labels.Nothing(), logger); !ok {
+		t.Errorf("Namespace released before the release protection is not a reap candidate")
+	}
+
+	if err := release(clientset, logger); err == nil {
+		t.Errorf("Expected error releasing namespace that is not quarantined")
+	}
+}
+
+func deploymentReplicas(t *testing.T, clientset kubernetes.Interface, name string) int32 {
+	deployment, err := clientset.AppsV1().Deployments("user-user2").Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error getting deployment %s: %v", name, err)
+	}
+	return replicasOrDefault(deployment.Spec.Replicas)
+}
@@ -0,0 +1,263 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/restmapper"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	restoreConflictSkip      = "skip"
+	restoreConflictOverwrite = "overwrite"
+	restoreConflictFail      = "fail"
+	restoreOrderLast         = 4
+)
+
+// restoreOrder is the order kinds are restored in so resources they depend on exist first, kinds not listed are restored last
+var restoreOrder = map[string]int{
+	"Namespace":                             0,
+	"ServiceAccount":                        1,
+	"Role.rbac.authorization.k8s.io":        1,
+	"RoleBinding.rbac.authorization.k8s.io": 1,
+	"ResourceQuota":                         1,
+	"LimitRange":                            1,
+	"ConfigMap":                             2,
+	"Secret":                                2,
+	"PersistentVolumeClaim":                 2,
+	"Service":                               2,
+	"Deployment.apps":                       3,
+	"StatefulSet.apps":                      3,
+	"DaemonSet.apps":                        3,
+	"ReplicaSet.apps":                       3,
+	"Job.batch":                             3,
+	"CronJob.batch":                         3,
+	"Pod":                                   3,
+}
+
+// restore recreates a namespace and its resources from an archive created before the namespace was reaped
+func restore(clientset kubernetes.Interface, dynamicClient dynamic.Interface, logger *slog.Logger) error {
+	objects, err := readNamespaceArchive(*restoreArchive)
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 || objects[0].GetKind() != "Namespace" {
+		return errors.New("archive does not contain a namespace")
+	}
+	namespace := objects[0].GetName()
+	if *restoreNamespace != "" {
+		namespace = *restoreNamespace
+	}
+	logger = logger.With("namespace", namespace)
+	groupResources, err := restmapper.GetAPIGroupResources(clientset.Discovery())
+	if err != nil {
+		return fmt.Errorf("error discovering resources: %w", err)
+	}
+	mapper := restmapper.NewDiscoveryRESTMapper(groupResources)
+
+	var restore []*unstructured.Unstructured
+	for _, obj := range objects {
+		if restoreSkipped(obj) {
+			logger.Debug("Skipping resource that is created automatically", "kind", obj.GetKind(), "name", obj.GetName())
+			continue
+		}
+		obj.SetOwnerReferences(nil)
+		restoreClearFields(obj)
+		if obj.GetKind() == "Namespace" {
+			obj.SetName(namespace)
+			annotations := obj.GetAnnotations()
+			delete(annotations, *scheduledAnnotation)
+			obj.SetAnnotations(annotations)
+		} else {
+			obj.SetNamespace(namespace)
+		}
+		restore = append(restore, obj)
+	}
+	sort.Slice(restore, func(i, j int) bool {
+		if pi, pj := restorePriority(restore[i]), restorePriority(restore[j]); pi != pj {
+			return pi < pj
+		}
+		if gki, gkj := restore[i].GroupVersionKind().GroupKind().String(), restore[j].GroupVersionKind().GroupKind().String(); gki != gkj {
+			return gki < gkj
+		}
+		return restore[i].GetName() < restore[j].GetName()
+	})
+
+	errCount := 0
+	restored := 0
+	for _, obj := range restore {
+		objLogger := logger.With("kind", obj.GetKind(), "name", obj.GetName())
+		gvk := obj.GroupVersionKind()
+		mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			errCount++
+			objLogger.Error("Unable to find resource for kind", "err", err)
+			continue
+		}
+		var client dynamic.ResourceInterface = dynamicClient.Resource(mapping.Resource)
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			client = dynamicClient.Resource(mapping.Resource).Namespace(namespace)
+		}
+		if *dryRun {
+			objLogger.Info("Dry run, would restore resource")
+			continue
+		}
+		_, err = client.Create(context.TODO(), obj, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			switch *restoreConflict {
+			case restoreConflictSkip:
+				objLogger.Info("Skipping resource that already exists")
+				continue
+			case restoreConflictOverwrite:
+				objLogger.Info("Overwriting resource that already exists")
+				err = restoreOverwrite(client, obj)
+			case restoreConflictFail:
+				return fmt.Errorf("%s %s already exists", obj.GetKind(), obj.GetName())
+			}
+		}
+		if err != nil {
+			if obj.GetKind() == "Namespace" {
+				return fmt.Errorf("error creating namespace: %w", err)
+			}
+			errCount++
+			objLogger.Error("Error restoring resource", "err", err)
+			continue
+		}
+		restored++
+		objLogger.Debug("Restored resource")
+	}
+	if *dryRun {
+		logger.Info("Dry run restore summary", "resources", len(restore))
+	} else {
+		logger.Info("Restore summary", "resources", restored, "errors", errCount)
+	}
+	if errCount > 0 {
+		return fmt.Errorf("%d errors encountered during restore", errCount)
+	}
+	return nil
+}
+
+// restoreOverwrite replaces an existing resource with the archived resource
+func restoreOverwrite(client dynamic.ResourceInterface, obj *unstructured.Unstructured) error {
+	existing, err := client.Get(context.TODO(), obj.GetName(), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	obj.SetResourceVersion(existing.GetResourceVersion())
+	_, err = client.Update(context.TODO(), obj, metav1.UpdateOptions{})
+	return err
+}
+
+// restoreSkipped returns true for resources that are recreated by Kubernetes, either by a controller that owns them
+// or when the namespace is created
+func restoreSkipped(obj *unstructured.Unstructured) bool {
+	if metav1.GetControllerOfNoCopy(obj) != nil {
+		return true
+	}
+	switch obj.GetKind() {
+	case "Secret":
+		secretType, _, _ := unstructured.NestedString(obj.Object, "type")
+		return secretType == "kubernetes.io/service-account-token"
+	case "ConfigMap":
+		return obj.GetName() == "kube-root-ca.crt"
+	}
+	return false
+}
+
+// restoreClearFields removes fields assigned by the cluster that would tie a restored resource to a cluster IP,
+// node or volume that may no longer be available so new ones are assigned instead
+func restoreClearFields(obj *unstructured.Unstructured) {
+	switch obj.GroupVersionKind().GroupKind().String() {
+	case "Service":
+		// Headless services must stay headless
+		if clusterIP, _, _ := unstructured.NestedString(obj.Object, "spec", "clusterIP"); clusterIP != "None" {
+			unstructured.RemoveNestedField(obj.Object, "spec", "clusterIP")
+			unstructured.RemoveNestedField(obj.Object, "spec", "clusterIPs")
+		}
+	case "Pod":
+		unstructured.RemoveNestedField(obj.Object, "spec", "nodeName")
+	case "PersistentVolumeClaim":
+		unstructured.RemoveNestedField(obj.Object, "spec", "volumeName")
+		annotations := obj.GetAnnotations()
+		delete(annotations, "pv.kubernetes.io/bind-completed")
+		delete(annotations, "pv.kubernetes.io/bound-by-controller")
+		obj.SetAnnotations(annotations)
+	}
+}
+
+func restorePriority(obj *unstructured.Unstructured) int {
+	gk := obj.GroupVersionKind().GroupKind()
+	if priority, ok := restoreOrder[gk.String()]; ok {
+		return priority
+	}
+	return restoreOrderLast
+}
+
+// readNamespaceArchive reads the resources in an archive, the namespace is always first
+func readNamespaceArchive(archive string) ([]*unstructured.Unstructured, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading archive %s: %w", archive, err)
+	}
+	tr := tar.NewReader(gz)
+	var objects []*unstructured.Unstructured
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading archive %s: %w", archive, err)
+		}
+		if header.Typeflag != tar.TypeReg || path.Ext(header.Name) != ".yaml" {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		obj := &unstructured.Unstructured{}
+		if err := yaml.Unmarshal(data, &obj.Object); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %w", header.Name, err)
+		}
+		if obj.GetKind() == "Namespace" {
+			objects = append([]*unstructured.Unstructured{obj}, objects...)
+		} else {
+			objects = append(objects, obj)
+		}
+	}
+	return objects, nil
+}
@@ -0,0 +1,278 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// restoreFixture archives a namespace with resources that are restored in order and resources that are skipped
+func restoreFixture(t *testing.T) string {
+	if _, err := kingpin.CommandLine.Parse([]string{"--archive-dir=" + t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	timeNow = func() time.Time {
+		return creationTime.Add((time.Hour * 24 * 9))
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	clientset := clientset()
+	archiveResources(clientset)
+	objects := archiveObjects("user-user2")
+	objects[0].(*unstructured.Unstructured).SetLabels(map[string]string{"app.kubernetes.io/name": "open-ondemand"})
+	objects[0].(*unstructured.Unstructured).SetAnnotations(map[string]string{"k8-namespace-reaper.osc.edu/scheduled-deletion": "2020-01-10T13:00:00Z"})
+	objects = append(objects,
+		&unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "rbac.authorization.k8s.io/v1",
+			"kind":       "Role",
+			"metadata":   map[string]any{"name": "admin", "namespace": "user-user2"},
+		}},
+		&unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "v1",
+			"kind":       "ServiceAccount",
+			"metadata":   map[string]any{"name": "web", "namespace": "user-user2"},
+		}},
+		&unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata":   map[string]any{"name": "web-token", "namespace": "user-user2"},
+			"type":       "kubernetes.io/service-account-token",
+		}},
+		&unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "v1",
+			"kind":       "Pod",
+			"metadata": map[string]any{
+				"name":      "web-1234",
+				"namespace": "user-user2",
+				"ownerReferences": []any{map[string]any{
+					"apiVersion": "apps/v1", "kind": "ReplicaSet", "name": "web-1234", "uid": "1", "controller": true,
+				}},
+			},
+		}},
+	)
+	// Cluster assigned IPs, nodes and volumes are removed when restoring
+	objects = append(objects,
+		&unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "v1",
+			"kind":       "Service",
+			"metadata":   map[string]any{"name": "web", "namespace": "user-user2"},
+			"spec":       map[string]any{"clusterIP": "10.96.0.10", "clusterIPs": []any{"10.96.0.10"}},
+		}},
+		&unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "v1",
+			"kind":       "Service",
+			"metadata":   map[string]any{"name": "db", "namespace": "user-user2"},
+			"spec":       map[string]any{"clusterIP": "None", "clusterIPs": []any{"None"}},
+		}},
+		&unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "v1",
+			"kind":       "Pod",
+			"metadata":   map[string]any{"name": "debug", "namespace": "user-user2"},
+			"spec":       map[string]any{"nodeName": "node1"},
+		}},
+		&unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "v1",
+			"kind":       "PersistentVolumeClaim",
+			"metadata": map[string]any{
+				"name":        "data",
+				"namespace":   "user-user2",
+				"annotations": map[string]any{"pv.kubernetes.io/bind-completed": "yes"},
+			},
+			"spec": map[string]any{"volumeName": "pvc-1234"},
+		}},
+	)
+	archive, err := archiveNamespace(context.Background(), clientset.Discovery(), dynamicClient(objects...), "user-user2", logger)
+	if err != nil {
+		t.Fatalf("Unexpected error archiving namespace: %v", err)
+	}
+	return archive
+}
+
+func createdResources(actions []clienttesting.Action) []string {
+	var created []string
+	for _, action := range actions {
+		if create, ok := action.(clienttesting.CreateAction); ok {
+			obj := create.GetObject().(*unstructured.Unstructured)
+			created = append(created, obj.GetNamespace()+"/"+action.GetResource().Resource+"/"+obj.GetName())
+		}
+	}
+	return created
+}
+
+func TestRestore(t *testing.T) {
+	archive := restoreFixture(t)
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	tests := []struct {
+		name      string
+		args      []string
+		namespace string
+		expected  []string
+	}{
+		{
+			name:      "restore",
+			args:      []string{},
+			namespace: "user-user2",
+			expected: []string{
+				"/namespaces/user-user2",
+				"user-user2/roles/admin",
+				"user-user2/serviceaccounts/web",
+				"user-user2/configmaps/config",
+				"user-user2/persistentvolumeclaims/data",
+				"user-user2/services/db",
+				"user-user2/services/web",
+				"user-user2/deployments/web",
+				"user-user2/pods/debug",
+			},
+		},
+		{
+			name:      "namespace",
+			args:      []string{"--namespace=user-copy"},
+			namespace: "user-copy",
+			expected: []string{
+				"/namespaces/user-copy",
+				"user-copy/roles/admin",
+				"user-copy/serviceaccounts/web",
+				"user-copy/configmaps/config",
+				"user-copy/persistentvolumeclaims/data",
+				"user-copy/services/db",
+				"user-copy/services/web",
+				"user-copy/deployments/web",
+				"user-copy/pods/debug",
+			},
+		},
+		{
+			name:     "dry run",
+			args:     []string{"--namespace=", "--dry-run"},
+			expected: nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := append([]string{"restore", archive}, test.args...)
+			if _, err := kingpin.CommandLine.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+			clientset := clientset()
+			archiveResources(clientset)
+			client := dynamicClient()
+			if err := restore(clientset, client, logger); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			created := createdResources(client.Actions())
+			if !reflect.DeepEqual(created, test.expected) {
+				t.Errorf("Unexpected restored resources\nExpected: %v\nGot: %v", test.expected, created)
+			}
+			if test.namespace == "" {
+				return
+			}
+			ns, err := client.Resource(schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}).Get(context.TODO(), test.namespace, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Unexpected error getting namespace: %v", err)
+			}
+			if ns.GetLabels()["app.kubernetes.io/name"] != "open-ondemand" || len(ns.GetAnnotations()) != 0 {
+				t.Errorf("Unexpected namespace metadata: %v %v", ns.GetLabels(), ns.GetAnnotations())
+			}
+			get := func(resource string, name string) *unstructured.Unstructured {
+				obj, err := client.Resource(schema.GroupVersionResource{Version: "v1", Resource: resource}).Namespace(test.namespace).Get(context.TODO(), name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatalf("Unexpected error getting %s %s: %v", resource, name, err)
+				}
+				return obj
+			}
+			if spec, _, _ := unstructured.NestedMap(get("services", "web").Object, "spec"); len(spec) != 0 {
+				t.Errorf("Unexpected service spec, cluster IPs not removed: %v", spec)
+			}
+			if clusterIP, _, _ := unstructured.NestedString(get("services", "db").Object, "spec", "clusterIP"); clusterIP != "None" {
+				t.Errorf("Unexpected headless service cluster IP: %s", clusterIP)
+			}
+			if nodeName, ok, _ := unstructured.NestedString(get("pods", "debug").Object, "spec", "nodeName"); ok {
+				t.Errorf("Unexpected pod node name: %s", nodeName)
+			}
+			pvc := get("persistentvolumeclaims", "data")
+			if volumeName, ok, _ := unstructured.NestedString(pvc.Object, "spec", "volumeName"); ok || len(pvc.GetAnnotations()) != 0 {
+				t.Errorf("Unexpected persistent volume claim binding: %s %v", volumeName, pvc.GetAnnotations())
+			}
+		})
+	}
+}
+
+func TestRestoreConflict(t *testing.T) {
+	archive := restoreFixture(t)
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	configMaps := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	tests := []struct {
+		conflict  string
+		expectErr bool
+		expected  string
+	}{
+		{conflict: "skip", expected: "existing"},
+		{conflict: "overwrite", expected: "bar"},
+		{conflict: "fail", expectErr: true, expected: "existing"},
+	}
+	for _, test := range tests {
+		t.Run(test.conflict, func(t *testing.T) {
+			if _, err := kingpin.CommandLine.Parse([]string{"restore", archive, "--namespace=", "--conflict=" + test.conflict}); err != nil {
+				t.Fatal(err)
+			}
+			clientset := clientset()
+			archiveResources(clientset)
+			client := dynamicClient(&unstructured.Unstructured{Object: map[string]any{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"metadata":   map[string]any{"name": "config", "namespace": "user-user2", "resourceVersion": "1"},
+				"data":       map[string]any{"foo": "existing"},
+			}})
+			err := restore(clientset, client, logger)
+			if test.expectErr && err == nil {
+				t.Errorf("Expected error")
+			} else if !test.expectErr && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			configMap, err := client.Resource(configMaps).Namespace("user-user2").Get(context.TODO(), "config", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Unexpected error getting config map: %v", err)
+			}
+			if val, _, _ := unstructured.NestedString(configMap.Object, "data", "foo"); val != test.expected {
+				t.Errorf("Unexpected config map data, expected: %s got: %s", test.expected, val)
+			}
+		})
+	}
+}
+
+func TestRestorePriority(t *testing.T) {
+	tests := map[schema.GroupVersionKind]int{
+		{Version: "v1", Kind: "Namespace"}:                                0,
+		{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "Role"}: 1,
+		{Version: "v1", Kind: "Secret"}:                                   2,
+		{Group: "apps", Version: "v1", Kind: "Deployment"}:                3,
+		{Group: "example.com", Version: "v1", Kind: "Deployment"}:         restoreOrderLast,
+	}
+	for gvk, expected := range tests {
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(gvk)
+		if priority := restorePriority(obj); priority != expected {
+			t.Errorf("Unexpected priority for %s, expected: %d got: %d", gvk.String(), expected, priority)
+		}
+	}
+}
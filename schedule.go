@@ -0,0 +1,110 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	eventReasonScheduled   = "ScheduledForDeletion"
+	eventReasonUnscheduled = "DeletionCanceled"
+)
+
+// scheduledDeletion returns when a namespace was scheduled to be deleted by a previous run
+func scheduledDeletion(namespace namespaceCandidate) (time.Time, bool) {
+	val, ok := namespace.Annotations[*scheduledAnnotation]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// scheduleDeletion marks a namespace to be deleted after the grace period and emits an event to warn users
+func scheduleDeletion(clientset kubernetes.Interface, namespace namespaceCandidate, deleteAt time.Time, reason string) error {
+	if err := patchScheduledAnnotation(clientset, namespace.Name, deleteAt.UTC().Format(time.RFC3339)); err != nil {
+		return err
+	}
+	scheduledFor := "deletion"
+	if *reapAction == reapActionQuarantine {
+		scheduledFor = "quarantine"
+	}
+	namespaceEvent(namespace.Name, namespace.UID, corev1.EventTypeWarning, eventReasonScheduled,
+		"Namespace is idle and scheduled for %s at %s: %s", scheduledFor, deleteAt.UTC().Format(time.RFC3339), reason)
+	return nil
+}
+
+// clearScheduled removes the scheduled deletion mark from namespaces that are no longer idle
+func clearScheduled(clientset kubernetes.Interface, idle []namespaceCandidate, logger *slog.Logger) int {
+	errCount := 0
+	idleNames := make(map[string]bool)
+	for _, namespace := range idle {
+		idleNames[namespace.Name] = true
+	}
+	namespaces, err := clientset.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		logger.Error("Error getting namespace list to clear scheduled deletions", "err", err)
+		return 1
+	}
+	for _, namespace := range namespaces.Items {
+		if _, ok := namespace.Annotations[*scheduledAnnotation]; !ok || idleNames[namespace.Name] {
+			continue
+		}
+		if namespace.Status.Phase == corev1.NamespaceTerminating {
+			continue
+		}
+		namespaceLogger := logger.With("namespace", namespace.Name)
+		if *dryRun {
+			namespaceLogger.Info("Dry run, would clear scheduled deletion of namespace that is no longer idle")
+			continue
+		}
+		namespaceLogger.Info("Clearing scheduled deletion of namespace that is no longer idle")
+		if err := patchScheduledAnnotation(clientset, namespace.Name, nil); err != nil {
+			errCount++
+			namespaceLogger.Error("Error clearing scheduled deletion", "err", err)
+			metricErrorsTotal.Inc()
+			continue
+		}
+		namespaceEvent(namespace.Name, namespace.UID, corev1.EventTypeNormal, eventReasonUnscheduled, "Namespace is no longer idle and will not be deleted")
+	}
+	return errCount
+}
+
+// patchScheduledAnnotation sets the scheduled deletion annotation, a nil value removes it
+func patchScheduledAnnotation(clientset kubernetes.Interface, namespace string, value any) error {
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]any{
+				*scheduledAnnotation: value,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = clientset.CoreV1().Namespaces().Patch(context.TODO(), namespace, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
@@ -0,0 +1,291 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	deletedLabel      = "k8-namespace-reaper.osc.edu/deleted"
+	deletedAnnotation = "k8-namespace-reaper.osc.edu/deleted-at"
+)
+
+// terminations tracks namespaces deleted by the reaper until they finish terminating
+var terminations = &terminationTracker{namespaces: make(map[string]trackedTermination)}
+
+type trackedTermination struct {
+	UID       types.UID
+	DeletedAt time.Time
+}
+
+type terminationTracker struct {
+	mu         sync.Mutex
+	namespaces map[string]trackedTermination
+}
+
+func (t *terminationTracker) add(name string, uid types.UID, deletedAt time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.namespaces[name] = trackedTermination{UID: uid, DeletedAt: deletedAt}
+}
+
+func (t *terminationTracker) remove(name string, uid types.UID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.namespaces[name].UID == uid {
+		delete(t.namespaces, name)
+	}
+}
+
+func (t *terminationTracker) list() map[string]trackedTermination {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	namespaces := make(map[string]trackedTermination, len(t.namespaces))
+	for name, tracked := range t.namespaces {
+		namespaces[name] = tracked
+	}
+	return namespaces
+}
+
+// validateTerminating checks the terminating and finalizer removal flags
+func validateTerminating() []error {
+	var errs []error
+	if *terminatingCheckInterval <= 0 {
+		errs = append(errs, errors.New("terminating check interval must be greater than 0"))
+	}
+	if *finalizerRemovalTimeout > 0 && *finalizerRemovalAllow == "" {
+		errs = append(errs, errors.New("must provide finalizers to remove when finalizer removal timeout is set"))
+	}
+	if *finalizerRemovalTimeout > 0 && *finalizerRemovalTimeout < *terminatingStuckAfter {
+		errs = append(errs, errors.New("finalizer removal timeout must not be shorter than terminating stuck after"))
+	}
+	return errs
+}
+
+// watchTerminating periodically checks on namespaces deleted by the reaper
+func watchTerminating(clientset kubernetes.Interface, dynamicClient dynamic.Interface, logger *slog.Logger) {
+	for {
+		sleep(*terminatingCheckInterval)
+		checkTerminating(clientset, dynamicClient, logger)
+	}
+}
+
+// markDeleted labels a namespace as deleted by the reaper and annotates when so it can be followed up on after
+// the reaper restarts. The resource version ensures a namespace changed since it was evaluated is not marked.
+func markDeleted(ctx context.Context, clientset kubernetes.Interface, namespace namespaceCandidate) (*corev1.Namespace, error) {
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"labels":          map[string]string{deletedLabel: "true"},
+			"annotations":     map[string]string{deletedAnnotation: timeNow().UTC().Format(time.RFC3339)},
+			"resourceVersion": namespace.ResourceVersion,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return clientset.CoreV1().Namespaces().Patch(ctx, namespace.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+}
+
+// trackMarked tracks terminating namespaces marked as deleted by the reaper, including those deleted before the
+// reaper restarted or by another replica
+func trackMarked(clientset kubernetes.Interface, logger *slog.Logger) int {
+	namespaces, err := clientset.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{LabelSelector: deletedLabel + "=true"})
+	if err != nil {
+		logger.Error("Error listing namespaces deleted by the reaper", "err", err)
+		return 1
+	}
+	tracked := terminations.list()
+	for _, namespace := range namespaces.Items {
+		if namespace.Status.Phase != corev1.NamespaceTerminating {
+			continue
+		}
+		if t, ok := tracked[namespace.Name]; ok && t.UID == namespace.UID {
+			continue
+		}
+		deletedAt, err := time.Parse(time.RFC3339, namespace.Annotations[deletedAnnotation])
+		if err != nil && namespace.DeletionTimestamp != nil {
+			deletedAt = namespace.DeletionTimestamp.Time
+		}
+		logger.Debug("Tracking terminating namespace deleted by the reaper", "namespace", namespace.Name, "deleted", deletedAt.String())
+		terminations.add(namespace.Name, namespace.UID, deletedAt)
+	}
+	return 0
+}
+
+// checkTerminating follows up on namespaces deleted by the reaper, recording how long they took to terminate
+// and reporting namespaces that are stuck terminating along with the conditions blocking them
+func checkTerminating(clientset kubernetes.Interface, dynamicClient dynamic.Interface, logger *slog.Logger) int {
+	errCount := trackMarked(clientset, logger)
+	terminating := 0
+	stuck := 0
+	now := timeNow()
+	metricTerminationBlocked.Reset()
+	for name, tracked := range terminations.list() {
+		namespaceLogger := logger.With("namespace", name)
+		namespace, err := clientset.CoreV1().Namespaces().Get(context.TODO(), name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) || (err == nil && namespace.UID != tracked.UID) {
+			duration := now.Sub(tracked.DeletedAt)
+			namespaceLogger.Info("Namespace finished terminating", "duration", duration.String())
+			metricTerminationDuration.Observe(duration.Seconds())
+			terminations.remove(name, tracked.UID)
+			continue
+		}
+		if err != nil {
+			errCount++
+			namespaceLogger.Error("Error getting terminating namespace", "err", err)
+			continue
+		}
+		terminating++
+		duration := now.Sub(tracked.DeletedAt)
+		if duration < *terminatingStuckAfter {
+			continue
+		}
+		stuck++
+		var blockers []string
+		for _, condition := range terminationBlockers(namespace) {
+			metricTerminationBlocked.WithLabelValues(name, string(condition.Type)).Set(1)
+			blockers = append(blockers, string(condition.Type)+": "+condition.Message)
+		}
+		namespaceLogger.Warn("Namespace stuck terminating", "duration", duration.String(), "conditions", strings.Join(blockers, "; "))
+		if *finalizerRemovalTimeout > 0 && duration >= *finalizerRemovalTimeout {
+			errCount += removeFinalizers(namespace, clientset, dynamicClient, namespaceLogger)
+		}
+	}
+	metricTerminating.Set(float64(terminating))
+	metricStuckTerminating.Set(float64(stuck))
+	return errCount
+}
+
+// terminationBlockers returns the namespace conditions that explain why a namespace has not finished terminating
+func terminationBlockers(namespace *corev1.Namespace) []corev1.NamespaceCondition {
+	var blockers []corev1.NamespaceCondition
+	for _, condition := range namespace.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case corev1.NamespaceDeletionDiscoveryFailure, corev1.NamespaceDeletionContentFailure, corev1.NamespaceDeletionGVParsingFailure,
+			corev1.NamespaceContentRemaining, corev1.NamespaceFinalizersRemaining:
+			blockers = append(blockers, condition)
+		}
+	}
+	return blockers
+}
+
+// removeFinalizers removes allowed finalizers from a stuck namespace and from resources in it that are being deleted
+func removeFinalizers(namespace *corev1.Namespace, clientset kubernetes.Interface, dynamicClient dynamic.Interface, logger *slog.Logger) int {
+	errCount := 0
+	if remaining, removed := withoutFinalizers(namespace.Finalizers); len(removed) > 0 {
+		gvr := schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+		if err := patchFinalizers(dynamicClient.Resource(gvr), namespace.Name, namespace.ResourceVersion, remaining); err != nil {
+			errCount++
+			logger.Error("Error removing namespace finalizers", "finalizers", strings.Join(removed, ","), "err", err)
+		} else {
+			finalizersRemoved(removed, "Namespace", namespace.Name, logger)
+		}
+	}
+	resources, err := discovery.ServerPreferredNamespacedResources(clientset.Discovery())
+	if err != nil {
+		// Unavailable API groups are a common reason for namespaces to be stuck so use what could be discovered
+		logger.Warn("Error discovering some namespaced resources", "err", err)
+	}
+	for _, list := range resources {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			continue
+		}
+		for _, resource := range list.APIResources {
+			if !slices.Contains(resource.Verbs, "list") || !slices.Contains(resource.Verbs, "patch") {
+				continue
+			}
+			client := dynamicClient.Resource(gv.WithResource(resource.Name)).Namespace(namespace.Name)
+			objects, err := client.List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				logger.Debug("Error listing resources for finalizer removal", "resource", resource.Name, "err", err)
+				continue
+			}
+			for _, obj := range objects.Items {
+				if obj.GetDeletionTimestamp() == nil {
+					continue
+				}
+				remaining, removed := withoutFinalizers(obj.GetFinalizers())
+				if len(removed) == 0 {
+					continue
+				}
+				if err := patchFinalizers(client, obj.GetName(), obj.GetResourceVersion(), remaining); err != nil {
+					errCount++
+					logger.Error("Error removing finalizers", "kind", obj.GetKind(), "name", obj.GetName(), "finalizers", strings.Join(removed, ","), "err", err)
+					continue
+				}
+				finalizersRemoved(removed, obj.GetKind(), obj.GetName(), logger)
+			}
+		}
+	}
+	return errCount
+}
+
+// withoutFinalizers splits finalizers into those that remain and those allowed to be removed
+func withoutFinalizers(finalizers []string) ([]string, []string) {
+	allowed := splitList(*finalizerRemovalAllow)
+	remaining := []string{}
+	var removed []string
+	for _, finalizer := range finalizers {
+		if slices.Contains(allowed, finalizer) {
+			removed = append(removed, finalizer)
+		} else {
+			remaining = append(remaining, finalizer)
+		}
+	}
+	return remaining, removed
+}
+
+// patchFinalizers replaces the finalizers of a resource, the resource version ensures finalizers added
+// since the resource was read are not removed
+func patchFinalizers(client dynamic.ResourceInterface, name string, resourceVersion string, finalizers []string) error {
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"finalizers":      finalizers,
+			"resourceVersion": resourceVersion,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.Patch(context.TODO(), name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+func finalizersRemoved(removed []string, kind string, name string, logger *slog.Logger) {
+	for _, finalizer := range removed {
+		logger.Warn("Removed finalizer from resource blocking namespace termination", "kind", kind, "name", name, "finalizer", finalizer)
+		metricFinalizersRemovedTotal.WithLabelValues(finalizer).Inc()
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func terminatingFixture(name string, uid string, conditions ...v1.NamespaceCondition) *v1.Namespace {
+	return &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			UID:               k8stypes.UID(uid),
+			DeletionTimestamp: &metav1.Time{Time: creationTime},
+			Finalizers:        []string{"example.com/cleanup"},
+		},
+		Status: v1.NamespaceStatus{Phase: v1.NamespaceTerminating, Conditions: conditions},
+	}
+}
+
+func TestCheckTerminating(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--terminating-stuck-after=1h"}); err != nil {
+		t.Fatal(err)
+	}
+	now := creationTime.Add(time.Hour * 2)
+	timeNow = func() time.Time {
+		return now
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	terminations = &terminationTracker{namespaces: make(map[string]trackedTermination)}
+	terminations.add("user-done", "uid-1", now.Add(-time.Minute*5))
+	terminations.add("user-recreated", "uid-2", now.Add(-time.Minute*5))
+	terminations.add("user-recent", "uid-3", now.Add(-time.Minute*5))
+	terminations.add("user-stuck", "uid-4", now.Add(-time.Hour*2))
+
+	recreated := terminatingFixture("user-recreated", "uid-5")
+	recreated.DeletionTimestamp = nil
+	clientset := fake.NewSimpleClientset(
+		recreated,
+		terminatingFixture("user-recent", "uid-3"),
+		terminatingFixture("user-stuck", "uid-4",
+			v1.NamespaceCondition{Type: v1.NamespaceDeletionContentFailure, Status: v1.ConditionTrue, Message: "failed to delete"},
+			v1.NamespaceCondition{Type: v1.NamespaceFinalizersRemaining, Status: v1.ConditionTrue, Message: "example.com/cleanup in 1 resource instances"},
+			v1.NamespaceCondition{Type: v1.NamespaceDeletionDiscoveryFailure, Status: v1.ConditionFalse},
+		),
+	)
+	dynamic := dynamicClient()
+
+	if errCount := checkTerminating(clientset, dynamic, logger); errCount != 0 {
+		t.Errorf("Unexpected error count: %d", errCount)
+	}
+	tracked := terminations.list()
+	if _, ok := tracked["user-done"]; ok {
+		t.Errorf("Deleted namespace still tracked")
+	}
+	if _, ok := tracked["user-recreated"]; ok {
+		t.Errorf("Recreated namespace still tracked")
+	}
+	if len(tracked) != 2 {
+		t.Errorf("Unexpected tracked namespaces: %v", tracked)
+	}
+	if terminating := testutil.ToFloat64(metricTerminating); terminating != 2 {
+		t.Errorf("Unexpected terminating: %v", terminating)
+	}
+	if stuck := testutil.ToFloat64(metricStuckTerminating); stuck != 1 {
+		t.Errorf("Unexpected stuck terminating: %v", stuck)
+	}
+	if blocked := testutil.CollectAndCount(metricTerminationBlocked); blocked != 2 {
+		t.Errorf("Unexpected blocked conditions: %d", blocked)
+	}
+	if v := testutil.ToFloat64(metricTerminationBlocked.WithLabelValues("user-stuck", string(v1.NamespaceFinalizersRemaining))); v != 1 {
+		t.Errorf("Unexpected blocked value: %v", v)
+	}
+	for _, action := range dynamic.Actions() {
+		if action.GetVerb() == "patch" {
+			t.Errorf("Unexpected patch without finalizer removal enabled: %v", action)
+		}
+	}
+}
+
+func TestTrackMarked(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	terminations = &terminationTracker{namespaces: make(map[string]trackedTermination)}
+	marked := terminatingFixture("user-marked", "uid-1")
+	marked.Labels = map[string]string{deletedLabel: "true"}
+	marked.Annotations = map[string]string{deletedAnnotation: "2020-01-01T14:00:00Z"}
+	noAnnotation := terminatingFixture("user-no-annotation", "uid-2")
+	noAnnotation.Labels = map[string]string{deletedLabel: "true"}
+	active := terminatingFixture("user-active", "uid-3")
+	active.Labels = map[string]string{deletedLabel: "true"}
+	active.DeletionTimestamp = nil
+	active.Status.Phase = v1.NamespaceActive
+	clientset := fake.NewSimpleClientset(marked, noAnnotation, active, terminatingFixture("user-unmarked", "uid-4"))
+
+	if errCount := trackMarked(clientset, logger); errCount != 0 {
+		t.Errorf("Unexpected error count: %d", errCount)
+	}
+	expected := map[string]trackedTermination{
+		"user-marked":        {UID: "uid-1", DeletedAt: creationTime.Add(time.Hour)},
+		"user-no-annotation": {UID: "uid-2", DeletedAt: creationTime},
+	}
+	tracked := terminations.list()
+	if len(tracked) != len(expected) {
+		t.Errorf("Unexpected tracked namespaces: %v", tracked)
+	}
+	for name, e := range expected {
+		if tracked[name].UID != e.UID || !tracked[name].DeletedAt.Equal(e.DeletedAt) {
+			t.Errorf("Unexpected tracking of %s\nExpected: %v\nGot: %v", name, e, tracked[name])
+		}
+	}
+}
+
+func TestCheckTerminatingRemoveFinalizers(t *testing.T) {
+	args := []string{
+		"--terminating-stuck-after=1h",
+		"--finalizer-removal-timeout=2h",
+		"--finalizer-removal-allow=example.com/cleanup",
+	}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	now := creationTime.Add(time.Hour * 3)
+	timeNow = func() time.Time {
+		return now
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	terminations = &terminationTracker{namespaces: make(map[string]trackedTermination)}
+	terminations.add("user-stuck", "uid-4", now.Add(-time.Hour*3))
+
+	namespace := terminatingFixture("user-stuck", "uid-4")
+	namespace.Finalizers = []string{"example.com/cleanup", "example.com/keep"}
+	clientset := fake.NewSimpleClientset(namespace)
+	clientset.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "namespaces", Kind: "Namespace", Verbs: []string{"get", "list", "patch"}},
+				{Name: "configmaps", Kind: "ConfigMap", Namespaced: true, Verbs: []string{"get", "list", "patch"}},
+				{Name: "secrets", Kind: "Secret", Namespaced: true, Verbs: []string{"get", "list"}},
+			},
+		},
+	}
+	object := func(kind string, name string, deleting bool) *unstructured.Unstructured {
+		metadata := map[string]any{
+			"name":            name,
+			"namespace":       "user-stuck",
+			"resourceVersion": "1",
+			"finalizers":      []any{"example.com/cleanup", "example.com/keep"},
+		}
+		if deleting {
+			metadata["deletionTimestamp"] = "2020-01-01T13:00:00Z"
+		}
+		return &unstructured.Unstructured{Object: map[string]any{"apiVersion": "v1", "kind": kind, "metadata": metadata}}
+	}
+	dynamic := dynamicClient(
+		&unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "v1",
+			"kind":       "Namespace",
+			"metadata": map[string]any{
+				"name":            "user-stuck",
+				"resourceVersion": "1",
+				"finalizers":      []any{"example.com/cleanup", "example.com/keep"},
+			},
+		}},
+		object("ConfigMap", "deleting", true),
+		object("ConfigMap", "active", false),
+		object("Secret", "deleting", true),
+	)
+
+	removedBefore := testutil.ToFloat64(metricFinalizersRemovedTotal.WithLabelValues("example.com/cleanup"))
+	if errCount := checkTerminating(clientset, dynamic, logger); errCount != 0 {
+		t.Errorf("Unexpected error count: %d", errCount)
+	}
+	if removed := testutil.ToFloat64(metricFinalizersRemovedTotal.WithLabelValues("example.com/cleanup")) - removedBefore; removed != 2 {
+		t.Errorf("Unexpected finalizers removed: %v", removed)
+	}
+	finalizers := func(resource string, namespace string, name string) []string {
+		gvr := schema.GroupVersionResource{Version: "v1", Resource: resource}
+		obj, err := dynamic.Resource(gvr).Namespace(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Unexpected error getting %s %s: %v", resource, name, err)
+		}
+		return obj.GetFinalizers()
+	}
+	if f := finalizers("namespaces", "", "user-stuck"); !slices.Equal(f, []string{"example.com/keep"}) {
+		t.Errorf("Unexpected namespace finalizers: %v", f)
+	}
+	if f := finalizers("configmaps", "user-stuck", "deleting"); !slices.Equal(f, []string{"example.com/keep"}) {
+		t.Errorf("Unexpected deleting configmap finalizers: %v", f)
+	}
+	if f := finalizers("configmaps", "user-stuck", "active"); len(f) != 2 {
+		t.Errorf("Finalizers removed from resource not being deleted: %v", f)
+	}
+	if f := finalizers("secrets", "user-stuck", "deleting"); len(f) != 2 {
+		t.Errorf("Finalizers removed from resource that can not be patched: %v", f)
+	}
+}
+
+func TestValidateTerminating(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--finalizer-removal-timeout=2h"}); err != nil {
+		t.Fatal(err)
+	}
+	if errs := validateTerminating(); len(errs) == 0 {
+		t.Errorf("Expected error without finalizers to remove")
+	}
+	args := []string{"--finalizer-removal-timeout=2h", "--finalizer-removal-allow=example.com/cleanup"}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if errs := validateTerminating(); len(errs) != 0 {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+}
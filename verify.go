@@ -0,0 +1,71 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// verifyNamespace re-fetches a namespace immediately before it is deleted to close the gap between when it was
+// evaluated and when it is deleted. It returns why the namespace should no longer be deleted or an empty string.
+func verifyNamespace(clientset kubernetes.Interface, candidate namespaceCandidate, logger *slog.Logger) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *deleteTimeout)
+	defer cancel()
+	namespace, err := clientset.CoreV1().Namespaces().Get(ctx, candidate.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "namespace no longer exists", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if namespace.UID != candidate.UID {
+		return "namespace was recreated", nil
+	}
+	if namespace.DeletionTimestamp != nil {
+		return "namespace is already being deleted", nil
+	}
+	if namespace.ResourceVersion != candidate.ResourceVersion {
+		excludeSelector, err := labels.Parse(*namespaceExcludeLabels)
+		if err != nil {
+			return "", err
+		}
+		current, ok := evaluateNamespace(*namespace, excludeSelector, logger)
+		if !ok {
+			return "namespace labels or annotations no longer allow it to be reaped", nil
+		}
+		if *gracePeriod > 0 {
+			if _, scheduled := scheduledDeletion(current); !scheduled {
+				return "scheduled deletion was cleared", nil
+			}
+		}
+		return "namespace changed since it was evaluated", nil
+	}
+	pods, err := clientset.CoreV1().Pods(candidate.Name).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return "", err
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodPending || pod.Status.Phase == corev1.PodRunning {
+			return "namespace has running pods", nil
+		}
+	}
+	return "", nil
+}
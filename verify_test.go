@@ -0,0 +1,157 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func verifyFixture(annotations map[string]string, resourceVersion string) *v1.Namespace {
+	return &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "user-user2",
+			UID:               "uid-1",
+			ResourceVersion:   resourceVersion,
+			Annotations:       annotations,
+			CreationTimestamp: metav1.NewTime(creationTime),
+		},
+	}
+}
+
+func TestVerifyNamespace(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--namespace-opt-out-annotation=reaper/opt-out"}); err != nil {
+		t.Fatal(err)
+	}
+	timeNow = func() time.Time {
+		return creationTime.Add((time.Hour * 24 * 9))
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	candidate := namespaceCandidate{Name: "user-user2", UID: "uid-1", ResourceVersion: "1"}
+	recreated := verifyFixture(nil, "1")
+	recreated.UID = "uid-2"
+	terminating := verifyFixture(nil, "1")
+	terminating.DeletionTimestamp = &metav1.Time{Time: creationTime}
+
+	tests := []struct {
+		name      string
+		objects   []runtime.Object
+		skipped   string
+		expectErr bool
+	}{
+		{name: "unchanged", objects: []runtime.Object{verifyFixture(nil, "1")}},
+		{name: "deleted", skipped: "namespace no longer exists"},
+		{name: "recreated", objects: []runtime.Object{recreated}, skipped: "namespace was recreated"},
+		{name: "terminating", objects: []runtime.Object{terminating}, skipped: "namespace is already being deleted"},
+		{name: "opted out", objects: []runtime.Object{verifyFixture(map[string]string{"reaper/opt-out": "true"}, "2")}, skipped: "namespace labels or annotations no longer allow it to be reaped"},
+		{name: "changed", objects: []runtime.Object{verifyFixture(map[string]string{"foo": "bar"}, "2")}, skipped: "namespace changed since it was evaluated"},
+		{
+			name: "running pod",
+			objects: []runtime.Object{verifyFixture(nil, "1"), &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "user-user2"},
+				Status:     v1.PodStatus{Phase: v1.PodRunning},
+			}},
+			skipped: "namespace has running pods",
+		},
+		{
+			name: "completed pod",
+			objects: []runtime.Object{verifyFixture(nil, "1"), &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "job", Namespace: "user-user2"},
+				Status:     v1.PodStatus{Phase: v1.PodSucceeded},
+			}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(test.objects...)
+			skipped, err := verifyNamespace(clientset, candidate, logger)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if skipped != test.skipped {
+				t.Errorf("Unexpected result\nExpected: %q\nGot: %q", test.skipped, skipped)
+			}
+		})
+	}
+
+	clientset := fake.NewSimpleClientset(verifyFixture(nil, "1"))
+	clientset.PrependReactor("get", "namespaces", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
+	if _, err := verifyNamespace(clientset, candidate, logger); err == nil {
+		t.Errorf("Expected error")
+	}
+}
+
+func TestReapPreconditions(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	candidate := namespaceCandidate{Name: "user-user2", UID: "uid-1", ResourceVersion: "1", Age: time.Hour * 200, ReapAfter: time.Hour * 168}
+
+	clientset := fake.NewSimpleClientset(verifyFixture(nil, "1"))
+	if errCount := reap([]namespaceCandidate{candidate}, clientset, nil, namespaceDeleter{}, nil, nil, logger); errCount != 0 {
+		t.Errorf("Unexpected error count: %d", errCount)
+	}
+	var patchAction clienttesting.PatchAction
+	var deleteAction clienttesting.DeleteAction
+	for _, action := range clientset.Actions() {
+		if a, ok := action.(clienttesting.PatchAction); ok && deleteAction == nil {
+			patchAction = a
+		}
+		if a, ok := action.(clienttesting.DeleteAction); ok {
+			deleteAction = a
+		}
+	}
+	if deleteAction == nil {
+		t.Fatalf("Namespace was not deleted")
+	}
+	if patchAction == nil || !strings.Contains(string(patchAction.GetPatch()), `"k8-namespace-reaper.osc.edu/deleted":"true"`) || !strings.Contains(string(patchAction.GetPatch()), `"resourceVersion":"1"`) {
+		t.Errorf("Namespace was not marked as deleted before deletion")
+	}
+	preconditions := deleteAction.GetDeleteOptions().Preconditions
+	if preconditions == nil || *preconditions.UID != "uid-1" || *preconditions.ResourceVersion != "1" {
+		t.Errorf("Unexpected preconditions: %+v", preconditions)
+	}
+
+	clientset = fake.NewSimpleClientset(verifyFixture(nil, "1"))
+	clientset.PrependReactor("delete", "namespaces", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "namespaces"}, "user-user2", errors.New("precondition failed"))
+	})
+	skippedBefore := testutil.ToFloat64(metricSkippedTotal)
+	if errCount := reap([]namespaceCandidate{candidate}, clientset, nil, namespaceDeleter{}, nil, nil, logger); errCount != 0 {
+		t.Errorf("Unexpected error count: %d", errCount)
+	}
+	if skipped := testutil.ToFloat64(metricSkippedTotal) - skippedBefore; skipped != 1 {
+		t.Errorf("Unexpected skipped total: %v", skipped)
+	}
+	if p := lastPlan.get(); len(p.Namespaces) != 1 || p.Namespaces[0].Action != actionSkip || p.Namespaces[0].Reaped {
+		t.Errorf("Unexpected plan: %+v", p)
+	}
+}
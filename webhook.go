@@ -0,0 +1,179 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+)
+
+const (
+	webhookRetryBackoff    = time.Second
+	webhookRetryMaxBackoff = 30 * time.Second
+)
+
+type webhookNotifier struct {
+	logger *slog.Logger
+}
+
+// webhookStatusError is returned when the webhook responds with an unsuccessful status
+type webhookStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("webhook returned status %d: %s", e.StatusCode, e.Body)
+}
+
+func (w *webhookNotifier) Name() string {
+	return "webhook"
+}
+
+func (w *webhookNotifier) Enabled(event string) bool {
+	return notifyEnabled(*webhookEvents, event)
+}
+
+// Notify posts a notification to the webhook, retrying with exponential backoff and jitter until the retry timeout
+func (w *webhookNotifier) Notify(ctx context.Context, n notification) error {
+	logger := w.logger.With("namespace", n.Namespace, "event", n.Event)
+	body, err := webhookBody(n)
+	if err != nil {
+		return err
+	}
+	retryCtx, cancel := context.WithTimeout(ctx, *webhookRetryTimeout)
+	defer cancel()
+	for attempt := 1; ; attempt++ {
+		err = w.post(ctx, body)
+		if err == nil {
+			logger.Debug("Sent webhook notification", "attempt", attempt)
+			return nil
+		}
+		if !retryableWebhookError(err) {
+			return err
+		}
+		backoff := retryBackoff(attempt, webhookRetryBackoff, webhookRetryMaxBackoff)
+		logger.Warn("Error sending webhook notification", "attempt", attempt, "err", err)
+		if retryCtx.Err() == nil {
+			select {
+			case <-retryCtx.Done():
+			case <-time.After(backoff):
+				continue
+			}
+		}
+		return fmt.Errorf("retry timeout reached after %d attempts: %w", attempt, err)
+	}
+}
+
+func (w *webhookNotifier) post(ctx context.Context, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, *webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, *webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", appName)
+	for name, value := range *webhookHeaders {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &webhookStatusError{StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+	return nil
+}
+
+// retryableWebhookError returns false for client errors that will not succeed if retried
+func retryableWebhookError(err error) bool {
+	statusErr, ok := err.(*webhookStatusError)
+	if !ok {
+		return true
+	}
+	switch statusErr.StatusCode {
+	case http.StatusTooManyRequests, http.StatusRequestTimeout:
+		return true
+	}
+	return statusErr.StatusCode >= 500
+}
+
+// webhookTemplate parses the webhook body template, nil means the notification is sent as JSON
+func webhookTemplate() (*template.Template, error) {
+	if *webhookBodyTemplate == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(*webhookBodyTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook template: %w", err)
+	}
+	return tmpl, nil
+}
+
+func webhookBody(n notification) ([]byte, error) {
+	tmpl, err := webhookTemplate()
+	if err != nil {
+		return nil, err
+	}
+	if tmpl == nil {
+		return json.Marshal(n)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, n); err != nil {
+		return nil, fmt.Errorf("error rendering webhook template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// validateWebhook checks the webhook flags
+func validateWebhook() []error {
+	var errs []error
+	if *webhookURL == "" {
+		return nil
+	}
+	if u, err := url.Parse(*webhookURL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("invalid webhook URL %q", *webhookURL))
+	}
+	if _, err := webhookTemplate(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := webhookBody(notification{Event: notifyEventReaped, Time: timeNow()}); err != nil {
+		errs = append(errs, err)
+	}
+	for _, event := range splitList(*webhookEvents) {
+		switch event {
+		case notifyEventWarned, notifyEventReaped, notifyEventFailed:
+		default:
+			errs = append(errs, fmt.Errorf("unknown webhook event %q", event))
+		}
+	}
+	return errs
+}
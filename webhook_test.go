@@ -0,0 +1,182 @@
+// Copyright 2020 Ohio Supercomputer Center
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+)
+
+func TestWebhookBody(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	n := notification{
+		Event:       notifyEventReaped,
+		Namespace:   "user-user2",
+		Labels:      map[string]string{"team": "a"},
+		Idle:        time.Hour * 200,
+		IdleSeconds: (time.Hour * 200).Seconds(),
+		Reason:      "age 216h0m0s exceeds reap-after 168h0m0s",
+		Time:        creationTime,
+	}
+	body, err := webhookBody(n)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		t.Fatalf("Unexpected error decoding body: %v", err)
+	}
+	if decoded["event"] != "reaped" || decoded["namespace"] != "user-user2" || decoded["idleSeconds"] != float64(720000) {
+		t.Errorf("Unexpected body: %s", body)
+	}
+
+	if _, err := kingpin.CommandLine.Parse([]string{`--webhook-template={"text": {{ printf "Namespace %s %s after idle %s: %s" .Namespace .Event .Idle .Reason | json }}}`}); err != nil {
+		t.Fatal(err)
+	}
+	body, err = webhookBody(n)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := `{"text": "Namespace user-user2 reaped after idle 200h0m0s: age 216h0m0s exceeds reap-after 168h0m0s"}`
+	if string(body) != expected {
+		t.Errorf("Unexpected body\nExpected: %s\nGot: %s", expected, body)
+	}
+}
+
+func TestWebhookNotify(t *testing.T) {
+	var requests atomic.Int32
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if requests.Add(1) == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		header = req.Header
+	}))
+	defer server.Close()
+	*webhookHeaders = map[string]string{}
+	args := []string{fmt.Sprintf("--webhook-url=%s", server.URL), "--webhook-header=X-Token=secret"}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	notifier := &webhookNotifier{logger: logger}
+	if err := notifier.Notify(context.Background(), notification{Event: notifyEventWarned, Namespace: "test"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if val := requests.Load(); val != 2 {
+		t.Errorf("Unexpected number of requests, got: %d", val)
+	}
+	if header.Get("X-Token") != "secret" || header.Get("Content-Type") != "application/json" {
+		t.Errorf("Unexpected headers: %v", header)
+	}
+	*webhookHeaders = map[string]string{}
+}
+
+func TestWebhookNotifyClientError(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		http.Error(rw, "bad payload", http.StatusBadRequest)
+	}))
+	defer server.Close()
+	if _, err := kingpin.CommandLine.Parse([]string{fmt.Sprintf("--webhook-url=%s", server.URL)}); err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	notifier := &webhookNotifier{logger: logger}
+	if err := notifier.Notify(context.Background(), notification{Event: notifyEventWarned, Namespace: "test"}); err == nil {
+		t.Errorf("Expected error")
+	}
+	if val := requests.Load(); val != 1 {
+		t.Errorf("Unexpected number of requests, got: %d", val)
+	}
+}
+
+func TestRunWebhook(t *testing.T) {
+	queryResults, err := os.ReadFile("testdata/prometheus-query.json")
+	if err != nil {
+		t.Fatalf("Error loading fixture data: %s", err.Error())
+	}
+	prometheusServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write(queryResults)
+	}))
+	defer prometheusServer.Close()
+	var mu sync.Mutex
+	var received []notification
+	webhookServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		var n notification
+		if err := json.Unmarshal(body, &n); err != nil {
+			t.Errorf("Unexpected error decoding notification: %v", err)
+		}
+		mu.Lock()
+		received = append(received, n)
+		mu.Unlock()
+	}))
+	defer webhookServer.Close()
+	address, _ := url.Parse(prometheusServer.URL)
+	args := []string{
+		"--namespace-labels=app.kubernetes.io/name=open-ondemand",
+		fmt.Sprintf("--prometheus-address=%s", address),
+		fmt.Sprintf("--webhook-url=%s", webhookServer.URL),
+	}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	timeNow = func() time.Time {
+		return creationTime.Add((time.Hour * 24 * 9))
+	}
+
+	if err := run(clientset(), nil, logger); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	notifications.Wait()
+	if len(received) != 1 {
+		t.Fatalf("Unexpected number of notifications, got: %d", len(received))
+	}
+	n := received[0]
+	if n.Event != notifyEventReaped || n.Namespace != "user-user2" || n.Labels["app.kubernetes.io/name"] != "open-ondemand" {
+		t.Errorf("Unexpected notification: %+v", n)
+	}
+	if n.IdleSeconds != (time.Hour * 168).Seconds() {
+		t.Errorf("Unexpected idle seconds: %v", n.IdleSeconds)
+	}
+}
+
+func TestValidateWebhook(t *testing.T) {
+	args := []string{"--webhook-url=foo", "--webhook-template={{ .Foo }}", "--webhook-events=reaped,deleted"}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if errs := validateWebhook(); len(errs) != 3 {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+}